@@ -0,0 +1,346 @@
+package rpg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Isolation determines which changes made by other calls to State.Atomic cause a call to
+// State.Atomic to retry.
+type Isolation int
+
+const (
+	// Snapshot retries if an Object that was modified or deleted by f has been modified
+	// or deleted since f started.
+	Snapshot Isolation = iota
+	// Serializable also retries if an Object that was retrieved by f using State.Get has
+	// been created, modified, or deleted since f retrieved it.
+	Serializable
+)
+
+// ErrAtomicAborted is returned by State.AtomicWithOptions when f returns false.
+var ErrAtomicAborted = errors.New("rpg: Atomic function returned false")
+
+// ConflictKind describes what happened to an Object that caused a call to State.Atomic to
+// fail to commit.
+type ConflictKind uint8
+
+const (
+	// ConflictModified means the Object was modified or created by another call to
+	// State.Atomic.
+	ConflictModified ConflictKind = 1 << iota
+	// ConflictDeleted means the Object was deleted by another call to State.Atomic.
+	ConflictDeleted
+)
+
+func (k ConflictKind) String() string {
+	switch k {
+	case ConflictModified:
+		return "modified"
+	case ConflictDeleted:
+		return "deleted"
+	case ConflictModified | ConflictDeleted:
+		return "modified and deleted"
+	}
+	return fmt.Sprintf("ConflictKind(%d)", uint8(k))
+}
+
+// Conflict is an Object that caused a call to State.Atomic to fail to commit.
+type Conflict struct {
+	ID   ObjectIndex
+	Kind ConflictKind
+}
+
+// ConflictError is returned by State.AtomicWithOptions when every attempt failed to
+// commit. Conflicts is from the last attempt and is sorted by ID.
+type ConflictError struct {
+	Attempts  int
+	Conflicts []Conflict
+}
+
+func (err *ConflictError) Error() string {
+	msg := fmt.Sprintf("rpg: Atomic failed to commit after %d attempts:", err.Attempts)
+	for i, c := range err.Conflicts {
+		if i != 0 {
+			msg += ","
+		}
+		msg += fmt.Sprintf(" object %d (%v)", c.ID, c.Kind)
+	}
+	return msg
+}
+
+// AtomicOptions controls the behavior of State.AtomicWithOptions. The zero value behaves
+// like State.Atomic.
+type AtomicOptions struct {
+	// Isolation determines which changes made by other calls to Atomic cause a retry.
+	Isolation Isolation
+
+	// MaxAttempts is the maximum number of times f is called. Zero means no limit.
+	MaxAttempts int
+
+	// Backoff, if non-nil, returns the time to wait before calling f again after the
+	// given attempt (starting at 1) failed to commit.
+	Backoff func(attempt int) time.Duration
+
+	// Context, if non-nil, stops retrying when it is done. It is checked before each
+	// call to f and while waiting for Backoff.
+	Context context.Context
+
+	// OnConflict, if non-nil, is called each time an attempt fails to commit.
+	OnConflict func(attempt int, conflicts []Conflict)
+}
+
+// ExponentialBackoff returns a function suitable for AtomicOptions.Backoff that waits min
+// after the first failed attempt and twice as long after each following attempt, up to
+// max.
+func ExponentialBackoff(min, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := min
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// Atomic calls f and tries to apply its changes. This is the only way a State should be
+// modified. f may be called multiple times if other calls to Atomic are being processed
+// at the same time. Returning false from f causes Atomic to return false without
+// applying the changes.
+//
+// Atomic may be called on the State passed to f. The inner changes are applied to the
+// outer State when the inner f returns true and discarded otherwise, and they are only
+// validated against the root State when the outermost call to Atomic commits. Inner calls
+// to Atomic on the same State, including concurrent ones, conflict with each other as if
+// it were the root State. Objects retrieved from the outer State before an inner call to
+// Atomic should be retrieved again with Get afterwards.
+func (s *State) Atomic(f func(*State) bool) bool {
+	return s.AtomicIsolation(Snapshot, f)
+}
+
+// AtomicIsolation is the same as Atomic, but conflicts are detected according to level.
+// If s is itself the State passed to a call to Atomic, the stricter of level and the
+// outer Isolation is used.
+func (s *State) AtomicIsolation(level Isolation, f func(*State) bool) bool {
+	return s.AtomicWithOptions(AtomicOptions{Isolation: level}, f) == nil
+}
+
+// AtomicWithOptions is the same as AtomicIsolation, but the number of attempts and the
+// time between them can be limited. The error is nil if the changes were applied,
+// ErrAtomicAborted if f returned false, a *ConflictError if opts.MaxAttempts was reached,
+// or the error from opts.Context if it was done.
+func (s *State) AtomicWithOptions(opts AtomicOptions, f func(*State) bool) error {
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		child := newState(s)
+		if child.isolation < opts.Isolation {
+			child.isolation = opts.Isolation
+		}
+		if !f(child) {
+			return ErrAtomicAborted
+		}
+
+		conflicts, n := s.commit(child)
+		if conflicts == nil {
+			if n != nil {
+				s.notify(n)
+			}
+			return nil
+		}
+
+		if opts.OnConflict != nil {
+			opts.OnConflict(attempt, conflicts)
+		}
+		if opts.MaxAttempts > 0 && attempt >= opts.MaxAttempts {
+			return &ConflictError{Attempts: attempt, Conflicts: conflicts}
+		}
+		if opts.Backoff != nil {
+			if d := opts.Backoff(attempt); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-t.C:
+				case <-ctx.Done():
+					t.Stop()
+					return ctx.Err()
+				}
+			}
+		}
+	}
+}
+
+type sortedConflicts []Conflict
+
+func (c sortedConflicts) Len() int           { return len(c) }
+func (c sortedConflicts) Less(i, j int) bool { return c[i].ID < c[j].ID }
+func (c sortedConflicts) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// commit applies the changes made in child to s. If child conflicts with changes made
+// to s since child was created, nothing is applied and the conflicts are returned. If s is
+// a root State, the returned notification must be passed to s.notify.
+func (s *State) commit(child *State) ([]Conflict, *notification) {
+	child.mtx.Lock()
+	defer child.mtx.Unlock()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	conflicts := make(map[ObjectIndex]ConflictKind)
+
+	if child.deletedVersion != s.deletedVersion {
+		for id, v1 := range s.deleted {
+			v2, ok := child.deleted[id]
+			if ok && v1 == v2 {
+				continue
+			}
+			if v, ok := child.recreated[id]; ok && v == v1 {
+				continue
+			}
+			o, touched := child.objects[id]
+			if _, read := child.reads[id]; !touched && !read {
+				continue
+			}
+			conflicts[id] |= ConflictDeleted
+			if ok || (o != nil && o.version != v1) {
+				conflicts[id] |= ConflictModified
+			}
+		}
+	}
+
+	// Reads are validated when the root State commits.
+	if s.parent == nil {
+		for id, v := range child.reads {
+			if p, ok := s.objects[id]; ok && p != nil {
+				if p.version != v {
+					conflicts[id] |= ConflictModified
+				}
+			} else if v2, ok := s.deleted[id]; ok && v != 0 {
+				conflicts[id] |= ConflictDeleted
+				if v2 != v {
+					conflicts[id] |= ConflictModified
+				}
+			}
+		}
+	}
+
+	for id, o := range child.objects {
+		p, ok := s.objects[id]
+		if !ok || p == nil {
+			// Either f created the Object or it was deleted from s, which
+			// was handled above.
+			continue
+		}
+		if o == nil {
+			if child.deleted[id] != p.version || (s.parent != nil && child.deletedLocal[id] != p.localVersion) {
+				conflicts[id] |= ConflictModified
+			}
+			if s.parent == nil {
+				// Any Object that started referring to the deleted Object
+				// after f looked at it would be left with a dangling reference.
+				for _, ref := range s.referrers[id] {
+					r, ok := child.objects[ref]
+					if !ok || (r != nil && s.objects[ref] != nil && r.version != s.objects[ref].version) {
+						conflicts[ref] |= ConflictModified
+					}
+				}
+			}
+			continue
+		}
+		if o.modified && (p.version != o.version || (s.parent != nil && p.localVersion != o.localBase)) {
+			// The version is only changed by the root State, so a change made
+			// by another call to Atomic nested in s is found by localVersion.
+			conflicts[id] |= ConflictModified
+		}
+	}
+
+	if len(conflicts) != 0 {
+		list := make(sortedConflicts, 0, len(conflicts))
+		for id, kind := range conflicts {
+			list = append(list, Conflict{ID: id, Kind: kind})
+		}
+		sort.Sort(list)
+		return []Conflict(list), nil
+	}
+
+	var n *notification
+	if s.parent == nil {
+		n = s.newNotification()
+	}
+
+	for id, o := range child.objects {
+		if o != nil && !o.modified {
+			continue
+		}
+		if o != nil {
+			// Only the root State assigns new versions. A child State keeps
+			// the version the Object had in the root so its own commit can
+			// be validated.
+			if s.parent == nil {
+				o.version = atomic.AddUint64(s.nextObjectVersion, 1)
+			} else {
+				o.localVersion = atomic.AddUint64(s.nextObjectVersion, 1)
+				if p := s.objects[id]; p != nil {
+					o.localBase = p.localBase
+				}
+			}
+			o.state = s
+		}
+		if s.parent == nil {
+			s.reindex(id, s.objects[id], o)
+			n.add(id, s.objects[id], o)
+		} else if p := s.objects[id]; o == nil && p != nil {
+			s.addDeletedLocal(id, p.localBase)
+		}
+		s.objects[id] = o
+	}
+
+	if child.componentSetsChanged && s.parent != nil {
+		atomic.AddUint64(s.componentsVersion, 1)
+		s.componentSetsChanged = true
+	}
+
+	deleted := false
+	for id, v := range child.deleted {
+		if _, ok := s.deleted[id]; !ok {
+			s.deleted[id] = v
+			deleted = true
+		}
+	}
+	for id, v := range child.recreated {
+		if _, ok := s.deleted[id]; !ok {
+			continue
+		}
+		delete(s.deleted, id)
+		deleted = true
+		if s.parent != nil {
+			s.addRecreated(id, v)
+		}
+	}
+	if deleted {
+		s.deletedVersion = atomic.AddUint64(s.nextObjectVersion, 1)
+	}
+
+	if s.parent != nil {
+		for id, v := range child.reads {
+			if _, ok := s.reads[id]; !ok {
+				s.reads[id] = v
+			}
+		}
+	}
+
+	return nil, n
+}
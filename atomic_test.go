@@ -0,0 +1,170 @@
+package rpg
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAtomicWithOptionsMaxAttempts(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+	b := testCreate(t, global, ResourcesFactory)
+
+	var backoff, conflicts []int
+	err := global.AtomicWithOptions(AtomicOptions{
+		MaxAttempts: 3,
+		Backoff: func(attempt int) time.Duration {
+			backoff = append(backoff, attempt)
+			return time.Millisecond
+		},
+		OnConflict: func(attempt int, c []Conflict) {
+			conflicts = append(conflicts, attempt)
+		},
+	}, func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 1)
+		s.Delete(b)
+		if !global.Atomic(func(s *State) bool {
+			s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 2)
+			s.Get(b).Component(ResourcesType).(*Resources).Set("gold", 2)
+			return true
+		}) {
+			t.Error("concurrent Atomic failed")
+		}
+		return true
+	})
+
+	expected := &ConflictError{
+		Attempts: 3,
+		Conflicts: []Conflict{
+			{ID: a, Kind: ConflictModified},
+			{ID: b, Kind: ConflictModified},
+		},
+	}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("expected %v, got %v", expected, err)
+	}
+	if !reflect.DeepEqual(backoff, []int{1, 2}) {
+		t.Errorf("unexpected calls to Backoff: %v", backoff)
+	}
+	if !reflect.DeepEqual(conflicts, []int{1, 2, 3}) {
+		t.Errorf("unexpected calls to OnConflict: %v", conflicts)
+	}
+}
+
+func TestAtomicWithOptionsDeleted(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+	b := testCreate(t, global, ResourcesFactory)
+
+	err := global.AtomicWithOptions(AtomicOptions{MaxAttempts: 1}, func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 1)
+		s.Get(b).Component(ResourcesType).(*Resources).Set("gold", 1)
+		if !global.Atomic(func(s *State) bool {
+			s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 2)
+			return true
+		}) {
+			t.Error("concurrent Atomic failed")
+		}
+		if !global.Atomic(func(s *State) bool {
+			s.Delete(a)
+			s.Delete(b)
+			return true
+		}) {
+			t.Error("concurrent Atomic failed")
+		}
+		return true
+	})
+
+	expected := &ConflictError{
+		Attempts: 1,
+		Conflicts: []Conflict{
+			{ID: a, Kind: ConflictModified | ConflictDeleted},
+			{ID: b, Kind: ConflictDeleted},
+		},
+	}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("expected %v, got %v", expected, err)
+	}
+}
+
+func TestAtomicUnrelatedDelete(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+	b := testCreate(t, global, ResourcesFactory)
+
+	err := global.AtomicWithOptions(AtomicOptions{MaxAttempts: 1}, func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 1)
+		if !global.Atomic(func(s *State) bool {
+			s.Delete(b)
+			return true
+		}) {
+			t.Error("concurrent Atomic failed")
+		}
+		return true
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if global.Get(b) != nil {
+		t.Error("deleted object exists again")
+	}
+}
+
+func TestAtomicWithOptionsAborted(t *testing.T) {
+	global := NewState()
+
+	if err := global.AtomicWithOptions(AtomicOptions{}, func(s *State) bool {
+		return false
+	}); err != ErrAtomicAborted {
+		t.Errorf("expected %v, got %v", ErrAtomicAborted, err)
+	}
+}
+
+func TestAtomicWithOptionsContext(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	attempts := 0
+	err := global.AtomicWithOptions(AtomicOptions{
+		Context: ctx,
+		Backoff: ExponentialBackoff(time.Hour, time.Hour),
+	}, func(s *State) bool {
+		attempts++
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 1)
+		if !global.Atomic(func(s *State) bool {
+			s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 2)
+			return true
+		}) {
+			t.Error("concurrent Atomic failed")
+		}
+		time.AfterFunc(time.Millisecond, cancel)
+		return true
+	})
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+	testResources(t, global, a, "gold", 2)
+
+	if err := global.AtomicWithOptions(AtomicOptions{Context: ctx}, func(s *State) bool {
+		t.Error("f called with a canceled Context")
+		return true
+	}); err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	f := ExponentialBackoff(time.Millisecond, 5*time.Millisecond)
+	for attempt, expected := range []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond} {
+		if d := f(attempt + 1); d != expected {
+			t.Errorf("attempt %d: expected %v, got %v", attempt+1, expected, d)
+		}
+	}
+}
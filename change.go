@@ -0,0 +1,211 @@
+package rpg
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+// ChangeKind describes what happened to an Object in a ChangeSet.
+type ChangeKind uint8
+
+const (
+	// ChangeCreated means the Object did not exist before the commit.
+	ChangeCreated ChangeKind = iota + 1
+	// ChangeModified means the Object was modified by the commit.
+	ChangeModified
+	// ChangeDeleted means the Object does not exist after the commit.
+	ChangeDeleted
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeCreated:
+		return "created"
+	case ChangeModified:
+		return "modified"
+	case ChangeDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("ChangeKind(%d)", uint8(k))
+}
+
+// Change describes an Object that was changed by a commit.
+type Change struct {
+	ID   ObjectIndex
+	Kind ChangeKind
+
+	// Components is the set of Component types that were added, removed, or modified,
+	// sorted by name. A Component is considered modified if its gob encoding changed.
+	Components []reflect.Type
+
+	old, new *Object
+}
+
+// ChangeSet is the set of changes made by a call to State.Atomic on a root State.
+type ChangeSet struct {
+	// Sequence is 1 for the first commit to a State and increases by 1 for each commit
+	// after that.
+	Sequence uint64
+
+	// Changes is sorted by ID.
+	Changes []Change
+}
+
+// Subscribe calls f with a ChangeSet each time a call to Atomic on s commits, in the
+// order of the commits. f is called before Atomic returns and must not call Atomic on s
+// or on the State of an Object in the ChangeSet. Calling the returned function stops
+// future calls to f. s must not be a child State, and commits that modify s without
+// calling Atomic are not reported. If f panics, the panic is passed on to the caller of
+// Atomic after the changes are committed, and the subscribers after f are not called for
+// that commit.
+func (s *State) Subscribe(f func(*ChangeSet)) (unsubscribe func()) {
+	if s.parent != nil {
+		panic("rpg: cannot subscribe to a child State")
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.subscribers == nil {
+		s.subscribers = make(map[uint64]func(*ChangeSet))
+	}
+	s.nextSubscriber++
+	id := s.nextSubscriber
+	s.subscribers[id] = f
+
+	return func() {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		delete(s.subscribers, id)
+	}
+}
+
+type notification struct {
+	sequence    uint64
+	subscribers []func(*ChangeSet)
+	changes     []Change
+}
+
+// newNotification starts a notification for a commit to a root State. s.mtx must be held.
+func (s *State) newNotification() *notification {
+	s.commits++
+	n := &notification{sequence: s.commits}
+
+	ids := make([]uint64, 0, len(s.subscribers))
+	for id := range s.subscribers {
+		ids = append(ids, id)
+	}
+	sort.Sort(sortedUint64(ids))
+	for _, id := range ids {
+		n.subscribers = append(n.subscribers, s.subscribers[id])
+	}
+
+	return n
+}
+
+// add records that the Object with the given id changed from old to o.
+func (n *notification) add(id ObjectIndex, old, o *Object) {
+	if len(n.subscribers) == 0 {
+		return
+	}
+
+	switch {
+	case old == nil && o == nil:
+		// Created and deleted in the same commit.
+	case old == nil:
+		n.changes = append(n.changes, Change{ID: id, Kind: ChangeCreated, old: old, new: o})
+	case o == nil:
+		n.changes = append(n.changes, Change{ID: id, Kind: ChangeDeleted, old: old, new: o})
+	default:
+		n.changes = append(n.changes, Change{ID: id, Kind: ChangeModified, old: old, new: o})
+	}
+}
+
+// notify delivers n to its subscribers after every earlier commit has been delivered.
+func (s *State) notify(n *notification) {
+	s.notifyMtx.Lock()
+	defer s.notifyMtx.Unlock()
+
+	for s.delivered+1 != n.sequence {
+		s.notifyCond.Wait()
+	}
+
+	// A subscriber that panics must not stop later commits from being delivered.
+	defer func() {
+		s.delivered = n.sequence
+		s.notifyCond.Broadcast()
+	}()
+
+	if len(n.subscribers) != 0 {
+		cs := &ChangeSet{Sequence: n.sequence, Changes: n.changes}
+		sort.Sort(sortedChanges(cs.Changes))
+		for i := range cs.Changes {
+			c := &cs.Changes[i]
+			c.Components = changedComponents(c.old, c.new)
+		}
+		for _, f := range n.subscribers {
+			f(cs)
+		}
+	}
+}
+
+// changedComponents returns the types of the Components that differ between old and o,
+// sorted by name. Either Object may be nil.
+func changedComponents(old, o *Object) []reflect.Type {
+	var types sortedTypes
+	if old != nil {
+		for t, c := range old.components {
+			if o == nil {
+				types = append(types, t)
+			} else if c2, ok := o.components[t]; !ok || !componentEqual(c, c2) {
+				types = append(types, t)
+			}
+		}
+	}
+	if o != nil {
+		for t := range o.components {
+			if old == nil {
+				types = append(types, t)
+			} else if _, ok := old.components[t]; !ok {
+				types = append(types, t)
+			}
+		}
+	}
+	sort.Sort(types)
+	return []reflect.Type(types)
+}
+
+// componentEqual returns true if a and b have the same gob encoding. Components that
+// cannot be encoded are never equal.
+func componentEqual(a, b Component) bool {
+	bufA, err := encodeComponent(a)
+	if err != nil {
+		return false
+	}
+	bufB, err := encodeComponent(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(bufA, bufB)
+}
+
+type sortedChanges []Change
+
+func (c sortedChanges) Len() int           { return len(c) }
+func (c sortedChanges) Less(i, j int) bool { return c[i].ID < c[j].ID }
+func (c sortedChanges) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+type sortedTypes []reflect.Type
+
+func (t sortedTypes) Len() int           { return len(t) }
+func (t sortedTypes) Less(i, j int) bool { return typeName(t[i]) < typeName(t[j]) }
+func (t sortedTypes) Swap(i, j int)      { t[i], t[j] = t[j], t[i] }
+
+type sortedUint64 []uint64
+
+func (u sortedUint64) Len() int           { return len(u) }
+func (u sortedUint64) Less(i, j int) bool { return u[i] < u[j] }
+func (u sortedUint64) Swap(i, j int)      { u[i], u[j] = u[j], u[i] }
@@ -0,0 +1,155 @@
+package rpg
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSubscribe(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+	b := testCreate(t, global, ResourcesFactory, LocationFactory)
+
+	var sets []*ChangeSet
+	unsubscribe := global.Subscribe(func(cs *ChangeSet) {
+		sets = append(sets, cs)
+	})
+
+	var c ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 10)
+		s.Get(b) // not modified
+		s.Delete(b)
+		c, _ = s.Create(ResourcesFactory)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	if len(sets) != 1 {
+		t.Fatalf("expected 1 ChangeSet, got %d", len(sets))
+	}
+	if sets[0].Sequence != 3 {
+		t.Errorf("expected sequence 3, got %d", sets[0].Sequence)
+	}
+	expected := []struct {
+		id         ObjectIndex
+		kind       ChangeKind
+		components []reflect.Type
+	}{
+		{a, ChangeModified, []reflect.Type{ResourcesType}},
+		{b, ChangeDeleted, []reflect.Type{LocationType, ResourcesType}},
+		{c, ChangeCreated, []reflect.Type{ResourcesType}},
+	}
+	if len(sets[0].Changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %+v", len(expected), sets[0].Changes)
+	}
+	for i, e := range expected {
+		c := sets[0].Changes[i]
+		if c.ID != e.id || c.Kind != e.kind || !reflect.DeepEqual(c.Components, e.components) {
+			t.Errorf("change %d: got %d %v %v, expected %d %v %v", i, c.ID, c.Kind, c.Components, e.id, e.kind, e.components)
+		}
+	}
+
+	// Modifying a component without changing it is not reported.
+	if !global.Atomic(func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 10)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	if len(sets) != 2 || len(sets[1].Changes) != 1 || len(sets[1].Changes[0].Components) != 0 {
+		t.Errorf("unexpected ChangeSet: %+v", sets[len(sets)-1])
+	}
+
+	unsubscribe()
+	testCreate(t, global, ResourcesFactory)
+	if len(sets) != 2 {
+		t.Errorf("subscriber called after unsubscribe")
+	}
+}
+
+func TestSubscribeOrder(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+
+	var last int64
+	sequence := uint64(1)
+	global.Subscribe(func(cs *ChangeSet) {
+		gold := global.Get(a).Component(ResourcesType).(*Resources).Get("gold")
+		if cs.Sequence != sequence+1 {
+			t.Errorf("expected sequence %d, got %d", sequence+1, cs.Sequence)
+		}
+		if gold < last {
+			t.Errorf("commits delivered out of order: %d after %d", gold, last)
+		}
+		sequence, last = cs.Sequence, gold
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				global.Atomic(func(s *State) bool {
+					r := s.Get(a).Component(ResourcesType).(*Resources)
+					r.Set("gold", r.Get("gold")+1)
+					return true
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sequence != 401 {
+		t.Errorf("expected 401 commits, got %d", sequence)
+	}
+}
+
+func TestSubscribePanic(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+
+	calls := 0
+	global.Subscribe(func(cs *ChangeSet) {
+		calls++
+		if calls == 1 {
+			panic("subscriber failed")
+		}
+	})
+
+	func() {
+		defer func() {
+			if r := recover(); r != "subscriber failed" {
+				t.Errorf("unexpected panic: %v", r)
+			}
+		}()
+		global.Atomic(func(s *State) bool {
+			s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 1)
+			return true
+		})
+	}()
+	testResources(t, global, a, "gold", 1)
+
+	done := make(chan bool)
+	go func() {
+		done <- global.Atomic(func(s *State) bool {
+			s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 2)
+			return true
+		})
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("Atomic failed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("commit after a panicking subscriber was never delivered")
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+}
@@ -1,13 +1,18 @@
 package rpg
 
-import "reflect"
+import (
+	"reflect"
+	"sync/atomic"
+)
 
 // Container is a Component that holds references to other Objects.
 type Container struct {
 	c sortedObjectIndices
 	o *Object
 
+	// by_component is valid while the State's componentsVersion is indexed.
 	by_component map[reflect.Type]sortedObjectIndices
+	indexed      uint64
 }
 
 // ContainerFactory is a ComponentFactory.
@@ -16,18 +21,20 @@ func ContainerFactory(o *Object) Component {
 }
 
 // ContainerType can be used with Object.Component to retrieve a Container.
-var ContainerType = RegisterComponent(ContainerFactory)
+var ContainerType = registerBuiltin("rpg.Container", ContainerFactory)
 
 // Clone implements Component.
 func (c *Container) Clone(o *Object) Component {
-	c.needComponents()
 	clone := &Container{
-		c:            append(sortedObjectIndices(nil), c.c...),
-		o:            o,
-		by_component: make(map[reflect.Type]sortedObjectIndices, len(c.by_component)),
+		c: append(sortedObjectIndices(nil), c.c...),
+		o: o,
 	}
-	for t, b := range c.by_component {
-		clone.by_component[t] = append(sortedObjectIndices(nil), b...)
+	if c.by_component != nil && c.indexed == atomic.LoadUint64(c.o.state.componentsVersion) {
+		clone.by_component = make(map[reflect.Type]sortedObjectIndices, len(c.by_component))
+		clone.indexed = c.indexed
+		for t, b := range c.by_component {
+			clone.by_component[t] = append(sortedObjectIndices(nil), b...)
+		}
 	}
 	return clone
 }
@@ -68,11 +75,14 @@ func (c *Container) Remove(v *Object) bool {
 	return false
 }
 
-// Contents returns the sorted set of Objects in c.
+// Contents returns the sorted set of Objects in c. Objects that no longer exist are
+// skipped.
 func (c *Container) Contents() []*Object {
-	contents := make([]*Object, len(c.c))
-	for i, id := range c.c {
-		contents[i] = c.o.State().Get(id)
+	contents := make([]*Object, 0, len(c.c))
+	for _, id := range c.c {
+		if o := c.o.State().Get(id); o != nil {
+			contents = append(contents, o)
+		}
 	}
 	return contents
 }
@@ -81,19 +91,40 @@ func (c *Container) Contents() []*Object {
 func (c *Container) ByComponent(t reflect.Type) []*Object {
 	c.needComponents()
 	b := c.by_component[t]
-	contents := make([]*Object, len(b))
-	for i, id := range b {
-		contents[i] = c.o.State().Get(id)
+	contents := make([]*Object, 0, len(b))
+	for _, id := range b {
+		if o := c.o.State().Get(id); o != nil {
+			contents = append(contents, o)
+		}
 	}
 	return contents
 }
 
+// References implements Referrer.
+func (c *Container) References() []ObjectIndex {
+	return append([]ObjectIndex(nil), c.c...)
+}
+
+// RemoveReference implements Referrer.
+func (c *Container) RemoveReference(id ObjectIndex) {
+	if c.c.remove(id) {
+		for t, b := range c.by_component {
+			b.remove(id)
+			c.by_component[t] = b
+		}
+		c.o.Modified()
+	}
+}
+
 func (c *Container) needComponents() {
-	if c.by_component != nil {
+	// Components added to or removed from any Object in the State invalidate the index.
+	v := atomic.LoadUint64(c.o.state.componentsVersion)
+	if c.by_component != nil && c.indexed == v {
 		return
 	}
 
 	c.by_component = make(map[reflect.Type]sortedObjectIndices)
+	c.indexed = v
 	for _, o := range c.Contents() {
 		for t := range o.components {
 			b := c.by_component[t]
@@ -0,0 +1,372 @@
+package rpg
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
+)
+
+// Delta is a set of changes to the Objects in a State. It can be encoded using gob,
+// applied to a State to move it forward, and inverted to move it backward.
+type Delta struct {
+	objects []objectDelta
+}
+
+type objectDelta struct {
+	id                   ObjectIndex
+	existed, exists      bool
+	oldParent, newParent ObjectIndex
+	components           []componentDelta
+}
+
+type componentDelta struct {
+	name     string
+	old, new []byte // nil if the Object does not have the Component
+}
+
+// DeltaMismatchError is returned by Delta.Apply when an Object in the State is not in the
+// state the Delta expects it to be in.
+type DeltaMismatchError struct {
+	ID ObjectIndex
+}
+
+func (err *DeltaMismatchError) Error() string {
+	return fmt.Sprintf("rpg: Delta does not match object %d", err.ID)
+}
+
+// NewDelta returns the Delta that changes from into to.
+func NewDelta(from, to *State) (*Delta, error) {
+	ids := sortedObjectIndices(from.IDs())
+	for _, id := range to.IDs() {
+		ids.add(id)
+	}
+
+	d := &Delta{}
+	for _, id := range ids {
+		if err := d.add(id, from.Get(id), to.Get(id)); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// Delta returns the Delta that was applied by the commit described by cs.
+func (cs *ChangeSet) Delta() (*Delta, error) {
+	d := &Delta{}
+	for _, c := range cs.Changes {
+		if err := d.add(c.ID, c.old, c.new); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// add records the change of the Object with the given id from old to o. Either may be
+// nil. Objects must be added in ascending order of id.
+func (d *Delta) add(id ObjectIndex, old, o *Object) error {
+	od := objectDelta{id: id, existed: old != nil, exists: o != nil}
+	names := make(map[string][2]Component)
+	if old != nil {
+		od.oldParent = old.parent
+		named, err := old.namedComponents()
+		if err != nil {
+			return err
+		}
+		for name, c := range named {
+			n := names[name]
+			n[0] = c
+			names[name] = n
+		}
+	}
+	if o != nil {
+		od.newParent = o.parent
+		named, err := o.namedComponents()
+		if err != nil {
+			return err
+		}
+		for name, c := range named {
+			n := names[name]
+			n[1] = c
+			names[name] = n
+		}
+	}
+
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	for _, name := range sorted {
+		cd := componentDelta{name: name}
+		var err error
+		if c := names[name][0]; c != nil {
+			if cd.old, err = encodeComponent(c); err != nil {
+				return err
+			}
+		}
+		if c := names[name][1]; c != nil {
+			if cd.new, err = encodeComponent(c); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(cd.old, cd.new) || (cd.old == nil) != (cd.new == nil) {
+			od.components = append(od.components, cd)
+		}
+	}
+
+	if od.existed == od.exists && od.oldParent == od.newParent && len(od.components) == 0 {
+		return nil
+	}
+	d.objects = append(d.objects, od)
+	return nil
+}
+
+// IDs returns the IDs of the Objects changed by d in ascending order.
+func (d *Delta) IDs() []ObjectIndex {
+	ids := make([]ObjectIndex, len(d.objects))
+	for i, od := range d.objects {
+		ids[i] = od.id
+	}
+	return ids
+}
+
+// Invert returns a Delta that undoes d.
+func (d *Delta) Invert() *Delta {
+	inverse := &Delta{objects: make([]objectDelta, len(d.objects))}
+	for i, od := range d.objects {
+		od.existed, od.exists = od.exists, od.existed
+		od.oldParent, od.newParent = od.newParent, od.oldParent
+		components := make([]componentDelta, len(od.components))
+		for j, cd := range od.components {
+			components[j] = componentDelta{name: cd.name, old: cd.new, new: cd.old}
+		}
+		od.components = components
+		inverse.objects[i] = od
+	}
+	return inverse
+}
+
+// Apply changes the Objects in s as described by d. If any Object in s does not match
+// the state d was created from, a *DeltaMismatchError is returned and s is not modified.
+// Subscribers are only notified if s is the State passed to a call to Atomic.
+func (d *Delta) Apply(s *State) error {
+	current := make([]*Object, len(d.objects))
+	for i, od := range d.objects {
+		o := s.Get(od.id)
+		if !od.matches(o) {
+			return &DeltaMismatchError{ID: od.id}
+		}
+		current[i] = o
+	}
+
+	replacements := make([]*Object, len(d.objects))
+	for i, od := range d.objects {
+		if !od.exists {
+			continue
+		}
+		o, err := od.apply(s, current[i])
+		if err != nil {
+			return err
+		}
+		replacements[i] = o
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	deleted := false
+	for i, od := range d.objects {
+		old, o := current[i], replacements[i]
+		if o == nil {
+			s.deleted[od.id] = old.version
+			if s.parent != nil {
+				s.addDeletedLocal(od.id, old.localBase)
+			}
+			deleted = true
+		} else {
+			if s.parent == nil {
+				o.version = atomic.AddUint64(s.nextObjectVersion, 1)
+			}
+			if v, ok := s.deleted[od.id]; ok {
+				delete(s.deleted, od.id)
+				deleted = true
+				if s.parent != nil {
+					s.addRecreated(od.id, v)
+				}
+			}
+		}
+		if s.parent == nil {
+			s.reindex(od.id, old, o)
+		}
+		s.objects[od.id] = o
+
+		for {
+			next := atomic.LoadUint64(s.nextObjectID)
+			if next >= uint64(od.id) || atomic.CompareAndSwapUint64(s.nextObjectID, next, uint64(od.id)) {
+				break
+			}
+		}
+	}
+	if deleted {
+		s.deletedVersion = atomic.AddUint64(s.nextObjectVersion, 1)
+	}
+	if s.parent != nil {
+		s.componentSetsChanged = true
+	}
+	// Bumped after the Objects are replaced so that no Container index can be built
+	// from the old Objects with the new version.
+	atomic.AddUint64(s.componentsVersion, 1)
+
+	return nil
+}
+
+// matches returns true if o is the Object od was created from.
+func (od *objectDelta) matches(o *Object) bool {
+	if (o != nil) != od.existed {
+		return false
+	}
+	if o == nil {
+		return true
+	}
+	if o.parent != od.oldParent {
+		return false
+	}
+
+	registry := o.state.Registry()
+	for _, cd := range od.components {
+		var c Component
+		_, t, err := registry.lookup(cd.name)
+		if registry.keeps(err) {
+			if op, ok := o.opaque[cd.name]; ok {
+				c = op
+			}
+		} else if err != nil {
+			return false
+		} else {
+			c = o.components[t]
+		}
+		ok := c != nil
+		if ok != (cd.old != nil) {
+			return false
+		}
+		if ok {
+			b, err := encodeComponent(c)
+			if err != nil {
+				return false
+			}
+			expected := cd.old
+			if _, ok := c.(gob.GobEncoder); !ok {
+				// The encoding includes gob type IDs, which depend on the
+				// order types were first encoded in this process.
+				if expected, err = reencodeComponent(cd.name, o, cd.old); err != nil {
+					return false
+				}
+			}
+			if !bytes.Equal(b, expected) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// apply returns a new Object for s that is old with the changes in od. old may be nil.
+func (od *objectDelta) apply(s *State, old *Object) (*Object, error) {
+	o := &Object{
+		id:         od.id,
+		parent:     od.newParent,
+		components: make(map[reflect.Type]Component),
+		modified:   true,
+		state:      s,
+	}
+	if old != nil {
+		o.version = old.version
+		o.localVersion, o.localBase = old.localVersion, old.localBase
+		for t, c := range old.components {
+			o.components[t] = c.Clone(o)
+		}
+		for name, c := range old.opaque {
+			if o.opaque == nil {
+				o.opaque = make(map[string]*Opaque, len(old.opaque))
+			}
+			o.opaque[name] = c.Clone(o).(*Opaque)
+		}
+	} else {
+		o.version = atomic.AddUint64(s.nextObjectVersion, 1)
+	}
+
+	registry := s.Registry()
+	for _, cd := range od.components {
+		f, t, err := registry.lookup(cd.name)
+		if registry.keeps(err) {
+			if cd.new == nil {
+				delete(o.opaque, cd.name)
+				continue
+			}
+			if o.opaque == nil {
+				o.opaque = make(map[string]*Opaque)
+			}
+			o.opaque[cd.name] = &Opaque{name: cd.name, data: cd.new}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cd.new == nil {
+			delete(o.components, t)
+			continue
+		}
+		c := f(o)
+		if err := registry.decodeComponentData(c, cd.new); err != nil {
+			return nil, err
+		}
+		o.components[t] = c
+	}
+	return o, nil
+}
+
+// encodeComponent returns the encoding of c on its own. Components that implement
+// gob.GobEncoder are encoded using GobEncode so that the encoding does not depend on
+// anything else encoded by this process.
+func encodeComponent(c Component) ([]byte, error) {
+	if e, ok := c.(gob.GobEncoder); ok {
+		return e.GobEncode()
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeComponentData is the inverse of encodeComponent, applying any Migrations.
+func (r *Registry) decodeComponentData(c Component, data []byte) error {
+	if d, ok := c.(gob.GobDecoder); ok {
+		if t := reflect.TypeOf(c); r.hasMigrations(t) {
+			var err error
+			if data, err = r.migrate(t, data); err != nil {
+				return err
+			}
+		}
+		return d.GobDecode(data)
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(c)
+}
+
+// reencodeComponent decodes data as the Component registered as name and encodes it again.
+func reencodeComponent(name string, o *Object, data []byte) ([]byte, error) {
+	registry := o.state.Registry()
+	f, _, err := registry.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	c := f(o)
+	if err := registry.decodeComponentData(c, data); err != nil {
+		return nil, err
+	}
+	return encodeComponent(c)
+}
@@ -0,0 +1,177 @@
+package rpg
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func testEncodeState(t *testing.T, s *State) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testDecodeState(t *testing.T, b []byte) *State {
+	s := &State{}
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestDeltaApplyInvert(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory, ContainerFactory)
+	b := testCreate(t, global, ResourcesFactory, LocationFactory)
+	if !global.Atomic(func(s *State) bool {
+		return s.Get(a).Component(ContainerType).(*Container).Add(s.Get(b))
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	before := testEncodeState(t, global)
+
+	var delta *Delta
+	unsubscribe := global.Subscribe(func(cs *ChangeSet) {
+		var err error
+		if delta, err = cs.Delta(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	var c ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 10)
+		s.Delete(b)
+		c, _ = s.Create(LocationFactory)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	unsubscribe()
+	after := testEncodeState(t, global)
+
+	if ids := delta.IDs(); !equalIDs(ids, []ObjectIndex{a, b, c}) {
+		t.Errorf("unexpected IDs: %v", ids)
+	}
+
+	// Round trip the Delta through gob.
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(delta); err != nil {
+		t.Fatal(err)
+	}
+	delta = &Delta{}
+	if err := gob.NewDecoder(&buf).Decode(delta); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := delta.Apply(global); err == nil {
+		t.Error("applying a Delta twice succeeded")
+	} else if _, ok := err.(*DeltaMismatchError); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if !global.Atomic(func(s *State) bool {
+		if err := delta.Invert().Apply(s); err != nil {
+			t.Error(err)
+			return false
+		}
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	if d, err := NewDelta(testDecodeState(t, before), global); err != nil {
+		t.Error(err)
+	} else if ids := d.IDs(); len(ids) != 0 {
+		t.Errorf("inverted Delta did not restore objects %v", ids)
+	}
+	testContents(t, global, a, b)
+	testByComponent(t, global, LocationType, b)
+
+	// Apply the Delta to a copy of the original State.
+	copied := testDecodeState(t, before)
+	if err := delta.Apply(copied); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(testEncodeState(t, copied), after) {
+		t.Error("Delta did not reproduce the State")
+	}
+	testByComponent(t, copied, LocationType, c)
+	testContents(t, copied, a)
+	if id, _ := copied.Create(); id <= c {
+		t.Errorf("created object %d after applying a Delta that created %d", id, c)
+	}
+}
+
+func TestDeltaInvertDeleteAtomic(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, NameFactory("a"))
+	b := testCreate(t, global, NameFactory("b"))
+	before := testDecodeState(t, testEncodeState(t, global))
+
+	if !global.Atomic(func(s *State) bool {
+		s.Delete(a)
+		s.Delete(b)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	d, err := NewDelta(before, global)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !global.Atomic(func(s *State) bool {
+		// Restore b in a nested call to Atomic.
+		return d.Invert().Apply(s) == nil && s.Atomic(func(s *State) bool {
+			s.Delete(b)
+			return true
+		}) && s.Atomic(func(s *State) bool {
+			return (&Delta{objects: d.Invert().objects[1:]}).Apply(s) == nil
+		})
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	decoded := testDecodeState(t, testEncodeState(t, global))
+	for _, s := range []*State{global, decoded} {
+		for _, id := range []ObjectIndex{a, b} {
+			if s.Get(id) == nil {
+				t.Errorf("object %d was not restored", id)
+			}
+		}
+	}
+}
+
+func TestNewDelta(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+	b := testCreate(t, global, LocationFactory)
+	before := testDecodeState(t, testEncodeState(t, global))
+
+	if !global.Atomic(func(s *State) bool {
+		s.Get(b).Component(LocationType).(*Location).Set(1, 2, 3)
+		s.Get(a).AddComponent(LocationFactory)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	delta, err := NewDelta(before, global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := delta.IDs(); !equalIDs(ids, []ObjectIndex{a, b}) {
+		t.Errorf("unexpected IDs: %v", ids)
+	}
+	if err := delta.Apply(before); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(testEncodeState(t, before), testEncodeState(t, global)) {
+		t.Error("Delta did not reproduce the State")
+	}
+	testByComponent(t, before, LocationType, a, b)
+	testIDs(t, "At", before.At(1, 2, 3), b)
+}
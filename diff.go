@@ -0,0 +1,239 @@
+package rpg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Differ is implemented by Components that can describe how they changed. Components that
+// do not implement Differ are only reported as changed by Diff.
+type Differ interface {
+	Component
+
+	// Diff returns a description of each difference between old, which has the same type
+	// as the receiver, and the receiver.
+	Diff(old Component) []string
+}
+
+// ObjectDiff describes how an Object differs between two States.
+type ObjectDiff struct {
+	ID   ObjectIndex
+	Kind ChangeKind
+
+	// OldParent and NewParent are the parents of the Object in each State. The one for
+	// the State the Object does not exist in is zero.
+	OldParent, NewParent ObjectIndex
+
+	// Components is sorted by name. For a created or deleted Object, it contains every
+	// Component the Object has.
+	Components []ComponentDiff
+}
+
+// ComponentDiff describes how a Component differs between two States.
+type ComponentDiff struct {
+	// Name is the registered name of the Component.
+	Name string
+
+	// Old is nil if the Component was added, and New is nil if it was removed.
+	Old, New Component
+
+	// Changes is the result of calling Diff if the Component implements Differ and was
+	// neither added nor removed.
+	Changes []string
+}
+
+func (d *ObjectDiff) String() string {
+	lines := []string{fmt.Sprintf("%v %d", d.Kind, d.ID)}
+	if d.Kind == ChangeModified && d.OldParent != d.NewParent {
+		lines = append(lines, fmt.Sprintf("\tparent changed from %d to %d", d.OldParent, d.NewParent))
+	}
+	for _, cd := range d.Components {
+		switch {
+		case cd.Old == nil && d.Kind == ChangeModified:
+			lines = append(lines, "\t"+cd.Name+": added")
+		case cd.New == nil && d.Kind == ChangeModified:
+			lines = append(lines, "\t"+cd.Name+": removed")
+		case len(cd.Changes) == 0:
+			lines = append(lines, "\t"+cd.Name)
+		default:
+			for _, c := range cd.Changes {
+				lines = append(lines, "\t"+cd.Name+": "+c)
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Diff returns the differences between each Object in from and the Object with the same
+// ObjectIndex in to, sorted by ID. Objects that are the same in both States are left out.
+// A Component is considered modified if its gob encoding changed. The States do not need
+// to be related, so they can be, for example, two frames of a history.History.
+func Diff(from, to *State) ([]ObjectDiff, error) {
+	ids := sortedObjectIndices(from.IDs())
+	for _, id := range to.IDs() {
+		ids.add(id)
+	}
+
+	var diffs []ObjectDiff
+	for _, id := range ids {
+		d, err := diffObject(id, from.Get(id), to.Get(id))
+		if err != nil {
+			return nil, err
+		}
+		if d != nil {
+			diffs = append(diffs, *d)
+		}
+	}
+	return diffs, nil
+}
+
+func diffObject(id ObjectIndex, old, new *Object) (*ObjectDiff, error) {
+	d := &ObjectDiff{ID: id, Kind: ChangeModified}
+	var oldNamed, newNamed map[string]Component
+	var err error
+	if old != nil {
+		if oldNamed, err = old.namedComponents(); err != nil {
+			return nil, err
+		}
+	}
+	if new != nil {
+		if newNamed, err = new.namedComponents(); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(oldNamed)+len(newNamed))
+	for name := range oldNamed {
+		names = append(names, name)
+	}
+	for name := range newNamed {
+		if _, ok := oldNamed[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	switch {
+	case old == nil:
+		d.Kind = ChangeCreated
+		d.NewParent = new.parent
+	case new == nil:
+		d.Kind = ChangeDeleted
+		d.OldParent = old.parent
+	default:
+		d.OldParent, d.NewParent = old.parent, new.parent
+	}
+
+	for _, name := range names {
+		cd := ComponentDiff{Name: name, Old: oldNamed[name], New: newNamed[name]}
+		if cd.Old != nil && cd.New != nil {
+			if componentEqual(cd.Old, cd.New) {
+				continue
+			}
+			if differ, ok := cd.New.(Differ); ok && reflect.TypeOf(cd.Old) == reflect.TypeOf(cd.New) {
+				cd.Changes = differ.Diff(cd.Old)
+			}
+		}
+		d.Components = append(d.Components, cd)
+	}
+
+	if d.Kind == ChangeModified && d.OldParent == d.NewParent && len(d.Components) == 0 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// Diff implements Differ.
+func (c *Container) Diff(old Component) []string {
+	o := old.(*Container)
+	var changes []string
+	for _, id := range c.c {
+		if !o.c.has(id) {
+			changes = append(changes, fmt.Sprintf("added %d", id))
+		}
+	}
+	for _, id := range o.c {
+		if !c.c.has(id) {
+			changes = append(changes, fmt.Sprintf("removed %d", id))
+		}
+	}
+	return changes
+}
+
+// Diff implements Differ.
+func (l *Location) Diff(old Component) []string {
+	o := old.(*Location)
+	if l.Equal(o) {
+		return nil
+	}
+	return []string{fmt.Sprintf("moved from (%d, %d, %d) to (%d, %d, %d)", o.x, o.y, o.z, l.x, l.y, l.z)}
+}
+
+// Diff implements Differ. Messages that are in the receiver but not in old are reported.
+func (m *Messages) Diff(old Component) []string {
+	count := make(map[Message]int)
+	for _, msg := range old.(*Messages).m {
+		count[msg]++
+	}
+	var changes []string
+	for _, msg := range m.m {
+		if count[msg] > 0 {
+			count[msg]--
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("new message from %d at %d: %q", msg.Source, msg.Time, msg.Text))
+	}
+	return changes
+}
+
+// Diff implements Differ.
+func (n *Name) Diff(old Component) []string {
+	if o := old.(*Name); *o != *n {
+		return []string{fmt.Sprintf("renamed from %q to %q", string(*o), string(*n))}
+	}
+	return nil
+}
+
+// Diff implements Differ.
+func (r *Random) Diff(old Component) []string {
+	o := old.(*Random)
+	if r.seed != o.seed {
+		return []string{fmt.Sprintf("seeded at position %d", r.position)}
+	}
+	if r.position != o.position {
+		return []string{fmt.Sprintf("advanced from position %d to %d", o.position, r.position)}
+	}
+	return nil
+}
+
+// Diff implements Differ. The values compared are the ones stored in each Resources,
+// without those inherited from the parent Object.
+func (r *Resources) Diff(old Component) []string {
+	o := old.(*Resources)
+	keys := make([]string, 0, len(r.r)+len(o.r))
+	for k := range r.r {
+		keys = append(keys, k)
+	}
+	for k := range o.r {
+		if _, ok := r.r[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, k := range keys {
+		v, ok := r.r[k]
+		ov, oldOK := o.r[k]
+		switch {
+		case !oldOK:
+			changes = append(changes, fmt.Sprintf("%s: added %d", k, v))
+		case !ok:
+			changes = append(changes, fmt.Sprintf("%s: removed (was %d)", k, ov))
+		case v != ov:
+			changes = append(changes, fmt.Sprintf("%s: %d -> %d (%+d)", k, ov, v, v-ov))
+		}
+	}
+	return changes
+}
@@ -0,0 +1,94 @@
+package rpg
+
+import (
+	"testing"
+)
+
+// diffTestComponent does not implement Differ.
+type diffTestComponent struct {
+	V int
+}
+
+func (c *diffTestComponent) Clone(*Object) Component {
+	clone := *c
+	return &clone
+}
+
+func TestDiff(t *testing.T) {
+	r := NewRegistry()
+	if _, err := r.RegisterName("rpg.diffTest", func(*Object) Component { return &diffTestComponent{} }); err != nil {
+		t.Fatal(err)
+	}
+
+	global := NewStateWithRegistry(r)
+	var bag, item, gone ObjectIndex
+	global.Atomic(func(s *State) bool {
+		var o *Object
+		bag, o = s.Create(ContainerFactory, LocationFactory, ResourcesFactory, MessagesFactory, NameFactory("bag"))
+		o.Component(ResourcesType).(*Resources).Set("gold", 10)
+		o.Component(ResourcesType).(*Resources).Set("silver", 3)
+		o.Component(MessagesType).(*Messages).Append(Message{Text: "old"})
+		item, _ = s.Create(LocationFactory)
+		gone, _ = s.Create(NameFactory("gone"))
+		s.Create(NameFactory("same"))
+		return true
+	})
+	from := testDecodeState(t, testEncodeState(t, global))
+
+	var created ObjectIndex
+	global.Atomic(func(s *State) bool {
+		o := s.Get(bag)
+		o.Component(ContainerType).(*Container).Add(s.Get(item))
+		o.Component(LocationType).(*Location).Set(1, 2, 3)
+		o.Component(ResourcesType).(*Resources).Set("gold", 15)
+		o.Component(ResourcesType).(*Resources).Set("copper", 1)
+		o.Component(MessagesType).(*Messages).Append(Message{Source: item, Time: 7, Text: "new"})
+		*o.Component(NameType).(*Name) = "sack"
+		o.Modified()
+		s.Delete(gone)
+		created, _ = s.Get(bag).Create(LocationFactory)
+		return true
+	})
+	global.Atomic(func(s *State) bool {
+		s.Get(item).AddComponent(func(*Object) Component { return &diffTestComponent{V: 1} })
+		return true
+	})
+
+	diffs, err := Diff(from, global)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []ObjectIndex
+	for _, d := range diffs {
+		ids = append(ids, d.ID)
+	}
+	if !equalIDs(ids, []ObjectIndex{bag, item, gone, created}) {
+		t.Fatalf("unexpected diffs for %v:\n%v", ids, diffs)
+	}
+
+	expected := []string{
+		"modified 1" +
+			"\n\trpg.Container: added 2" +
+			"\n\trpg.Location: moved from (0, 0, 0) to (1, 2, 3)" +
+			"\n\trpg.Messages: new message from 2 at 7: \"new\"" +
+			"\n\trpg.Name: renamed from \"bag\" to \"sack\"" +
+			"\n\trpg.Resources: copper: added 1" +
+			"\n\trpg.Resources: gold: 10 -> 15 (+5)",
+		"modified 2\n\trpg.Location: moved from (0, 0, 0) to (1, 2, 3)\n\trpg.diffTest: added",
+		"deleted 3\n\trpg.Name",
+		"created 5\n\trpg.Location",
+	}
+	for i, d := range diffs {
+		if s := d.String(); s != expected[i] {
+			t.Errorf("expected:\n%s\ngot:\n%s", expected[i], s)
+		}
+	}
+	if diffs[3].NewParent != bag || diffs[3].OldParent != 0 {
+		t.Errorf("unexpected parents %d and %d", diffs[3].OldParent, diffs[3].NewParent)
+	}
+
+	if diffs, err = Diff(global, global); err != nil || len(diffs) != 0 {
+		t.Errorf("expected no differences, got %v (%v)", diffs, err)
+	}
+}
@@ -1,13 +1,17 @@
 package rpg
 
 import (
+	"bufio"
 	"bytes"
 	"container/heap"
 	"encoding/binary"
 	"encoding/gob"
 	"errors"
+	"hash"
+	"hash/crc32"
 	"io"
 	"reflect"
+	"sort"
 	"sync/atomic"
 )
 
@@ -16,9 +20,21 @@ func readUvarint(buf []byte) (uint64, []byte, error) {
 	if i == 0 {
 		return x, buf, io.ErrUnexpectedEOF
 	}
+	if i < 0 {
+		return x, buf, ErrVarintOverflow
+	}
 	return x, buf[i:], nil
 }
 
+// readUvarintFrom is the same as readUvarint, but it reads from r.
+func readUvarintFrom(r io.ByteReader) (uint64, error) {
+	x, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return x, err
+}
+
 func writeUvarint(buf []byte, x uint64) []byte {
 	var b [binary.MaxVarintLen64]byte
 	i := binary.PutUvarint(b[:], x)
@@ -30,6 +46,9 @@ func readVarint(buf []byte) (int64, []byte, error) {
 	if i == 0 {
 		return x, buf, io.ErrUnexpectedEOF
 	}
+	if i < 0 {
+		return x, buf, ErrVarintOverflow
+	}
 	return x, buf[i:], nil
 }
 
@@ -50,6 +69,26 @@ func readString(buf []byte) (string, []byte, error) {
 	return string(buf[:l]), buf[l:], nil
 }
 
+// readStringFrom is the same as readString, but it reads from r.
+func readStringFrom(r io.ByteReader) (string, error) {
+	l, err := readUvarintFrom(r)
+	if err != nil {
+		return "", err
+	}
+	var buf []byte
+	for i := uint64(0); i < l; i++ {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf, b)
+	}
+	return string(buf), nil
+}
+
 func writeString(buf []byte, s string) []byte {
 	buf = writeUvarint(buf, uint64(len(s)))
 	return append(buf, s...)
@@ -57,7 +96,13 @@ func writeString(buf []byte, s string) []byte {
 
 var (
 	ErrStateParent         = errors.New("rpg: cannot encode a child State")
+	ErrVarintOverflow      = errors.New("rpg: varint overflows a 64-bit integer")
 	ErrStateVersion        = errors.New("rpg: unrecognized State version")
+	ErrStateChecksum       = errors.New("rpg: State checksum does not match")
+	ErrStateOutOfOrder     = errors.New("rpg: State is out of order")
+	ErrObjectComponents    = errors.New("rpg: Object has more components than its encoding")
+	ErrContainerSize       = errors.New("rpg: Container is larger than its encoding")
+	ErrResourcesSize       = errors.New("rpg: Resources is larger than its encoding")
 	ErrObjectStateless     = errors.New("rpg: cannot decode Object directly")
 	ErrObjectVersion       = errors.New("rpg: unrecognized Object version")
 	ErrContainerVersion    = errors.New("rpg: unrecognized Container version")
@@ -66,56 +111,143 @@ var (
 	ErrResourcesDuplicate  = errors.New("rpg: duplicate key in Resources")
 	ErrLocationVersion     = errors.New("rpg: unrecognized Location version")
 	ErrMessagesVersion     = errors.New("rpg: unrecognized Messages version")
+	ErrRandomVersion       = errors.New("rpg: unrecognized Random version")
+	ErrDeltaVersion        = errors.New("rpg: unrecognized Delta version")
+	ErrDeltaOutOfOrder     = errors.New("rpg: Delta is out of order")
 )
 
 const (
-	stateVersion     = 0
+	stateVersion     = 2
 	objectVersion    = 1
 	containerVersion = 0
 	resourcesVersion = 0
 	locationVersion  = 0
 	messagesVersion  = 0
+	randomVersion    = 0
+	deltaVersion     = 0
 )
 
 // GobEncode implements gob.GobEncoder
 func (s *State) GobEncode() (data []byte, err error) {
+	var buf bytes.Buffer
+	err = s.EncodeTo(&buf)
+	data = buf.Bytes()
+	return
+}
+
+// EncodeTo writes the same encoding as GobEncode to w. Objects are encoded one at a time
+// in ascending order of ID, so only their IDs are held in memory.
+func (s *State) EncodeTo(w io.Writer) (err error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
 	if s.parent != nil {
-		return nil, ErrStateParent
+		return ErrStateParent
 	}
 
 	s.clearDeleted()
 
+	bw := bufio.NewWriter(w)
+	h := crc32.New(checksumTable)
+	cw := io.MultiWriter(bw, h)
+	var data []byte
 	data = writeUvarint(data, stateVersion)
 	data = writeUvarint(data, atomic.LoadUint64(s.nextObjectID))
+
+	migrations := s.encodedMigrations()
+	data = writeUvarint(data, uint64(len(migrations)))
+	for _, name := range migrations {
+		data = writeString(data, name)
+	}
 	data = writeUvarint(data, uint64(len(s.objects)))
-	h := make(sortedObjectIndices, 0, len(s.objects))
+	if _, err = cw.Write(data); err != nil {
+		return
+	}
+
+	ids := make(sortedObjectIndices, 0, len(s.objects))
 	for id := range s.objects {
-		heap.Push(&h, id)
+		ids = append(ids, id)
 	}
-	objects := make([]*Object, 0, len(s.objects))
-	for len(h) > 0 {
-		id := heap.Pop(&h).(ObjectIndex)
-		data = writeUvarint(data, uint64(id))
-		objects = append(objects, s.objects[id])
+	sort.Sort(ids)
+	for _, id := range ids {
+		if _, err = cw.Write(writeUvarint(data[:0], uint64(id))); err != nil {
+			return
+		}
 	}
 
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	for _, o := range objects {
-		err = enc.Encode(o)
+	enc := gob.NewEncoder(cw)
+	for _, id := range ids {
+		err = enc.Encode(s.objects[id])
 		if err != nil {
 			return
 		}
 	}
-	data = append(data, buf.Bytes()...)
-	return
+
+	// The checksum covers everything before it.
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], h.Sum32())
+	if _, err = bw.Write(sum[:]); err != nil {
+		return
+	}
+	return bw.Flush()
 }
 
-// GobDecode implements gob.GobDecoder
+// GobDecode implements gob.GobDecoder. Any StateMigration in the State's Registry that
+// was not run before the State was encoded is run after it is decoded.
 func (s *State) GobDecode(data []byte) (err error) {
+	return s.DecodeFrom(bytes.NewReader(data))
+}
+
+// DecodeFrom is the same as GobDecode, but the encoding is read from r. Objects are
+// decoded one at a time. If r does not implement io.ByteReader, DecodeFrom may read past
+// the end of the encoding.
+//
+// Invalid input causes an error rather than a panic, and encodings written since the
+// checksum was added are verified against it. If the encoding is invalid, s is not
+// changed. DecodeFrom does not check references between Objects; see DecodeValidated.
+func (s *State) DecodeFrom(r io.Reader) (err error) {
+	err = s.decodeFrom(r)
+	if err != nil {
+		return
+	}
+	return s.migrate()
+}
+
+// DecodeValidated is the same as DecodeFrom, but the decoded State is also checked
+// using Validate.
+func (s *State) DecodeValidated(r io.Reader) error {
+	if err := s.DecodeFrom(r); err != nil {
+		return err
+	}
+	return s.Validate()
+}
+
+// checksumReader computes the checksum of the data read from r.
+type checksumReader struct {
+	r byteReader
+	h hash.Hash32
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+func (c *checksumReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+func (s *State) decodeFrom(r io.Reader) (err error) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
@@ -123,57 +255,112 @@ func (s *State) GobDecode(data []byte) (err error) {
 		return ErrStateParent
 	}
 
-	version, data, err := readUvarint(data)
+	raw, ok := r.(byteReader)
+	if !ok {
+		raw = bufio.NewReader(r)
+	}
+	cr := &checksumReader{r: raw, h: crc32.New(checksumTable)}
+	br := io.ByteReader(cr)
+	r = cr
+
+	// Nothing in s is changed until the whole encoding has been read and verified.
+	version, err := readUvarintFrom(br)
 	if err != nil {
 		return
 	}
-	if version != stateVersion {
+	if version > stateVersion {
 		return ErrStateVersion
 	}
-	if s.nextObjectID == nil {
-		s.objects = make(map[ObjectIndex]*Object)
-		s.by_component = make(map[reflect.Type][]ObjectIndex)
-		s.deleted = make(map[ObjectIndex]uint64)
-		s.nextObjectID = new(uint64)
-		s.nextObjectVersion = new(uint64)
-	}
 
-	nextID, data, err := readUvarint(data)
+	nextID, err := readUvarintFrom(br)
 	if err != nil {
 		return
 	}
-	atomic.StoreUint64(s.nextObjectID, nextID)
 
-	objectCount, data, err := readUvarint(data)
+	var migrations []string
+	if version >= 1 {
+		var count uint64
+		count, err = readUvarintFrom(br)
+		if err != nil {
+			return
+		}
+		for i := uint64(0); i < count; i++ {
+			var name string
+			name, err = readStringFrom(br)
+			if err != nil {
+				return
+			}
+			migrations = append(migrations, name)
+		}
+	}
+
+	objectCount, err := readUvarintFrom(br)
 	if err != nil {
 		return
 	}
 
-	objects := make([]*Object, objectCount)
-	for i := range objects {
+	var ids []ObjectIndex
+	for i := uint64(0); i < objectCount; i++ {
 		var id uint64
-		id, data, err = readUvarint(data)
+		id, err = readUvarintFrom(br)
 		if err != nil {
 			return
 		}
-		objects[i] = &Object{id: ObjectIndex(id), state: s}
+		if id == 0 || (len(ids) != 0 && ObjectIndex(id) <= ids[len(ids)-1]) {
+			return ErrStateOutOfOrder
+		}
+		ids = append(ids, ObjectIndex(id))
 	}
 
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	s.objects = make(map[ObjectIndex]*Object, objectCount)
-	for _, o := range objects {
+	dec := gob.NewDecoder(r)
+	objects := make([]*Object, len(ids))
+	for i, id := range ids {
+		o := &Object{id: id, state: s}
 		err = dec.Decode(o)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
 		if err != nil {
 			return
 		}
-		s.objects[o.id] = o
-		for t := range o.components {
-			s.by_component[t] = append(s.by_component[t], o.id)
+		objects[i] = o
+	}
+
+	if version >= 2 {
+		expected := cr.h.Sum32()
+		var sum [4]byte
+		if _, err = io.ReadFull(raw, sum[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if binary.LittleEndian.Uint32(sum[:]) != expected {
+			return ErrStateChecksum
 		}
 	}
+
+	if s.nextObjectID == nil {
+		s.deleted = make(map[ObjectIndex]uint64)
+		var a [3]uint64
+		s.nextObjectID, s.nextObjectVersion, s.componentsVersion = &a[0], &a[1], &a[2]
+		s.notifyCond.L = &s.notifyMtx
+	}
+	atomic.StoreUint64(s.nextObjectID, nextID)
+	s.migrations = migrations
+	s.objects = make(map[ObjectIndex]*Object, len(objects))
+	s.by_component = make(map[reflect.Type]sortedObjectIndices)
+	s.referrers = make(map[ObjectIndex]sortedObjectIndices)
+	s.spatial = make(map[chunk]sortedObjectIndices)
+	for _, o := range objects {
+		s.objects[o.id] = o
+		s.reindex(o.id, nil, o)
+	}
 	return
 }
 
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
 type componentHeapElement struct {
 	t string
 	c Component
@@ -198,13 +385,17 @@ func (o *Object) GobEncode() (data []byte, err error) {
 	data = writeUvarint(data, objectVersion)
 	data = writeUvarint(data, uint64(o.parent))
 
-	h := make(componentHeap, 0, len(o.components))
-	for t, c := range o.components {
-		heap.Push(&h, componentHeapElement{t: typeName(t), c: c})
+	named, err := o.namedComponents()
+	if err != nil {
+		return
+	}
+	h := make(componentHeap, 0, len(named))
+	for name, c := range named {
+		heap.Push(&h, componentHeapElement{t: name, c: c})
 	}
 
-	data = writeUvarint(data, uint64(len(o.components)))
-	components := make([]Component, 0, len(o.components))
+	data = writeUvarint(data, uint64(len(named)))
+	components := make([]Component, 0, len(named))
 	for len(h) != 0 {
 		c := heap.Pop(&h).(componentHeapElement)
 		data = writeString(data, c.t)
@@ -251,7 +442,11 @@ func (o *Object) GobDecode(data []byte) (err error) {
 	if err != nil {
 		return
 	}
+	if componentCount > uint64(len(data)) {
+		return ErrObjectComponents
+	}
 
+	registry := o.state.Registry()
 	components := make([]Component, componentCount)
 	for i := range components {
 		var tn string
@@ -259,23 +454,39 @@ func (o *Object) GobDecode(data []byte) (err error) {
 		if err != nil {
 			return
 		}
-		f, ok := registeredComponents[tn]
-		if !ok {
-			return errors.New("rpg: unregistered component factory " + tn)
+		var f ComponentFactory
+		f, _, err = registry.lookup(tn)
+		if registry.keeps(err) {
+			components[i], err = &Opaque{name: tn}, nil
+			continue
+		}
+		if err != nil {
+			return
 		}
 		components[i] = f(o)
 	}
 
 	dec := gob.NewDecoder(bytes.NewReader(data))
 	o.components = make(map[reflect.Type]Component, componentCount)
+	o.opaque = nil
 	for _, c := range components {
-		err = dec.Decode(c)
+		err = registry.decodeComponent(dec, c)
 		if err != nil {
 			return
 		}
+		if op, ok := c.(*Opaque); ok {
+			if _, ok := o.opaque[op.name]; ok {
+				return &DuplicateComponentError{Name: op.name}
+			}
+			if o.opaque == nil {
+				o.opaque = make(map[string]*Opaque)
+			}
+			o.opaque[op.name] = op
+			continue
+		}
 		t := reflect.TypeOf(c)
 		if _, ok := o.components[t]; ok {
-			panic("rpg: multiple components of type " + t.String())
+			return &DuplicateComponentError{Name: typeName(t)}
 		}
 		o.components[t] = c
 	}
@@ -305,6 +516,9 @@ func (c *Container) GobDecode(data []byte) (err error) {
 	if err != nil {
 		return
 	}
+	if count > uint64(len(data)) {
+		return ErrContainerSize
+	}
 	c.c = make(sortedObjectIndices, count)
 	for i := range c.c {
 		var id uint64
@@ -371,6 +585,9 @@ func (r *Resources) GobDecode(data []byte) (err error) {
 	if err != nil {
 		return
 	}
+	if count > uint64(len(data)) {
+		return ErrResourcesSize
+	}
 	r.r = make(map[string]int64, count)
 	for i := uint64(0); i < count; i++ {
 		var id string
@@ -422,6 +639,45 @@ func (l *Location) GobDecode(data []byte) (err error) {
 	return
 }
 
+// GobEncode implements gob.GobEncoder
+func (r *Random) GobEncode() (data []byte, err error) {
+	data = writeUvarint(data, randomVersion)
+	data = writeUvarint(data, r.seed)
+	data = writeUvarint(data, r.position)
+	return
+}
+
+// GobDecode implements gob.GobDecoder
+func (r *Random) GobDecode(data []byte) (err error) {
+	version, data, err := readUvarint(data)
+	if err != nil {
+		return
+	}
+	if version != randomVersion {
+		return ErrRandomVersion
+	}
+	r.seed, data, err = readUvarint(data)
+	if err != nil {
+		return
+	}
+	r.position, data, err = readUvarint(data)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// GobEncode implements gob.GobEncoder
+func (c *Opaque) GobEncode() ([]byte, error) {
+	return c.data, nil
+}
+
+// GobDecode implements gob.GobDecoder
+func (c *Opaque) GobDecode(data []byte) error {
+	c.data = append([]byte(nil), data...)
+	return nil
+}
+
 // GobEncode implements gob.GobEncoder
 func (m *Messages) GobEncode() (data []byte, err error) {
 	data = writeUvarint(data, messagesVersion)
@@ -453,3 +709,118 @@ func (m *Messages) GobDecode(data []byte) (err error) {
 
 	return
 }
+
+// writeOptionalBytes writes b such that a nil slice can be distinguished from an empty one.
+func writeOptionalBytes(buf, b []byte) []byte {
+	if b == nil {
+		return writeUvarint(buf, 0)
+	}
+	buf = writeUvarint(buf, uint64(len(b))+1)
+	return append(buf, b...)
+}
+
+func readOptionalBytes(buf []byte) ([]byte, []byte, error) {
+	l, buf, err := readUvarint(buf)
+	if err != nil || l == 0 {
+		return nil, buf, err
+	}
+	l--
+	if l > uint64(len(buf)) {
+		return nil, buf, io.ErrUnexpectedEOF
+	}
+	return append([]byte{}, buf[:l]...), buf[l:], nil
+}
+
+// GobEncode implements gob.GobEncoder
+func (d *Delta) GobEncode() (data []byte, err error) {
+	data = writeUvarint(data, deltaVersion)
+	data = writeUvarint(data, uint64(len(d.objects)))
+	for _, od := range d.objects {
+		data = writeUvarint(data, uint64(od.id))
+		var flags uint64
+		if od.existed {
+			flags |= 1
+		}
+		if od.exists {
+			flags |= 2
+		}
+		data = writeUvarint(data, flags)
+		data = writeUvarint(data, uint64(od.oldParent))
+		data = writeUvarint(data, uint64(od.newParent))
+		data = writeUvarint(data, uint64(len(od.components)))
+		for _, cd := range od.components {
+			data = writeString(data, cd.name)
+			data = writeOptionalBytes(data, cd.old)
+			data = writeOptionalBytes(data, cd.new)
+		}
+	}
+	return
+}
+
+// GobDecode implements gob.GobDecoder
+func (d *Delta) GobDecode(data []byte) (err error) {
+	version, data, err := readUvarint(data)
+	if err != nil {
+		return
+	}
+	if version != deltaVersion {
+		return ErrDeltaVersion
+	}
+	count, data, err := readUvarint(data)
+	if err != nil {
+		return
+	}
+	d.objects = nil
+	for i := uint64(0); i < count; i++ {
+		var od objectDelta
+		var id, flags, parent, componentCount uint64
+		id, data, err = readUvarint(data)
+		if err != nil {
+			return
+		}
+		od.id = ObjectIndex(id)
+		if len(d.objects) != 0 && d.objects[len(d.objects)-1].id >= od.id {
+			return ErrDeltaOutOfOrder
+		}
+		flags, data, err = readUvarint(data)
+		if err != nil {
+			return
+		}
+		od.existed, od.exists = flags&1 != 0, flags&2 != 0
+		parent, data, err = readUvarint(data)
+		if err != nil {
+			return
+		}
+		od.oldParent = ObjectIndex(parent)
+		parent, data, err = readUvarint(data)
+		if err != nil {
+			return
+		}
+		od.newParent = ObjectIndex(parent)
+		componentCount, data, err = readUvarint(data)
+		if err != nil {
+			return
+		}
+		for j := uint64(0); j < componentCount; j++ {
+			var cd componentDelta
+			cd.name, data, err = readString(data)
+			if err != nil {
+				return
+			}
+			if len(od.components) != 0 && od.components[len(od.components)-1].name >= cd.name {
+				return ErrDeltaOutOfOrder
+			}
+			cd.old, data, err = readOptionalBytes(data)
+			if err != nil {
+				return
+			}
+			cd.new, data, err = readOptionalBytes(data)
+			if err != nil {
+				return
+			}
+			od.components = append(od.components, cd)
+		}
+		d.objects = append(d.objects, od)
+	}
+	return
+}
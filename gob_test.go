@@ -0,0 +1,146 @@
+package rpg
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+// onlyReader hides any methods of r other than Read.
+type onlyReader struct {
+	r io.Reader
+}
+
+func (r onlyReader) Read(p []byte) (int, error) { return r.r.Read(p) }
+
+func TestEncodeToDecodeFrom(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory, ContainerFactory)
+	b := testCreate(t, global, LocationFactory)
+	global.Atomic(func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 10)
+		return s.Get(a).Component(ContainerType).(*Container).Add(s.Get(b))
+	})
+
+	var buf bytes.Buffer
+	if err := global.EncodeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := global.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), encoded) {
+		t.Fatal("EncodeTo and GobEncode differ")
+	}
+
+	decoded := NewState()
+	if err := decoded.DecodeFrom(onlyReader{&buf}); err != nil {
+		t.Fatal(err)
+	}
+	testResources(t, decoded, a, "gold", 10)
+	testContents(t, decoded, a, b)
+
+	// Consecutive States can be read from one stream.
+	buf.Reset()
+	global.EncodeTo(&buf)
+	testCreate(t, global, ResourcesFactory)
+	global.EncodeTo(&buf)
+	br := bufio.NewReader(&buf)
+	for _, expected := range []int{2, 3} {
+		s := NewState()
+		if err := s.DecodeFrom(br); err != nil {
+			t.Fatal(err)
+		}
+		if ids := s.IDs(); len(ids) != expected {
+			t.Errorf("expected %d objects, got %v", expected, ids)
+		}
+	}
+
+	for i := 0; i < len(encoded); i++ {
+		if err := NewState().DecodeFrom(bytes.NewReader(encoded[:i])); err != io.ErrUnexpectedEOF {
+			t.Errorf("decoding %d of %d bytes: expected io.ErrUnexpectedEOF, got %v", i, len(encoded), err)
+		}
+	}
+}
+
+func TestDecodeFromError(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+	global.Atomic(func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 10)
+		return true
+	})
+	encoded, err := global.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other := NewState()
+	b := testCreate(t, other, LocationFactory)
+	testCreate(t, other, LocationFactory)
+
+	// A State that fails to decode is left as it was.
+	corrupt := append([]byte(nil), encoded...)
+	corrupt[len(corrupt)-1] ^= 0xff
+	if err := other.GobDecode(corrupt); err != ErrStateChecksum {
+		t.Fatalf("expected ErrStateChecksum, got %v", err)
+	}
+	if ids := other.IDs(); len(ids) != 2 || ids[0] != b {
+		t.Errorf("State changed by failed decode: %v", ids)
+	}
+	if other.Get(b).Component(LocationType) == nil {
+		t.Error("Object changed by failed decode")
+	}
+
+	overflow := bytes.Repeat([]byte{0xff}, 11)
+	if _, _, err := readUvarint(overflow); err != ErrVarintOverflow {
+		t.Errorf("expected ErrVarintOverflow, got %v", err)
+	}
+	if _, _, err := readVarint(overflow); err != ErrVarintOverflow {
+		t.Errorf("expected ErrVarintOverflow, got %v", err)
+	}
+}
+
+func fuzzSeeds(f *testing.F) {
+	global := NewState()
+	a := testCreate(f, global, ContainerFactory, LocationFactory, NameFactory("a"))
+	b := testCreate(f, global, ResourcesFactory, MessagesFactory, LocationFactory)
+	global.Atomic(func(s *State) bool {
+		s.Get(b).Component(ResourcesType).(*Resources).Set("gold", 10)
+		s.Get(b).Component(MessagesType).(*Messages).Append(Message{Source: a, Text: "hi"})
+		return s.Get(a).Component(ContainerType).(*Container).Add(s.Get(b))
+	})
+	for _, s := range []*State{NewState(), global} {
+		encoded, err := s.GobEncode()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(encoded)
+
+		// The same State without a checksum, as written before it was added.
+		v1 := append([]byte{1}, encoded[1:len(encoded)-4]...)
+		f.Add(v1)
+	}
+}
+
+func FuzzStateDecode(f *testing.F) {
+	fuzzSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		s := NewState()
+		if err := s.GobDecode(data); err != nil {
+			return
+		}
+		if s.Validate() != nil {
+			return
+		}
+		// A valid State can be used and encoded again.
+		for _, id := range s.IDs() {
+			s.Get(id).ComponentAny(ResourcesType)
+		}
+		if _, err := s.GobEncode(); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package history
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const branchSuffix = ".branch"
+
+var ErrBranchName = errors.New("history: branch name must be non-empty and must not contain a path separator")
+
+// Branches is a set of named copies of a history file, such as futures that were abandoned
+// by calling History.Truncate. A branch named name of the file at path is stored next to
+// it, in path.name.branch.
+//
+// Each branch is a complete copy of the file, including the frames it shares with the
+// file and with other branches, so keeping a branch for every undo uses disk space in
+// proportion to the length of the game times the number of branches. Set Max to limit
+// the number of branches that are kept.
+type Branches struct {
+	path string
+
+	// Max is the number of branches kept by Save. If it is positive, Save removes the
+	// branches that were saved least recently until at most Max are left, never removing
+	// the branch it saved.
+	Max int
+}
+
+// NewBranches returns the Branches of the history file at path.
+func NewBranches(path string) *Branches {
+	return &Branches{path: path}
+}
+
+func (b *Branches) filename(name string) (string, error) {
+	if name == "" || strings.ContainsRune(name, filepath.Separator) || strings.ContainsRune(name, '/') {
+		return "", ErrBranchName
+	}
+	return b.path + "." + name + branchSuffix, nil
+}
+
+// List returns the names of the branches, sorted.
+func (b *Branches) List() ([]string, error) {
+	branches, err := b.list()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(branches))
+	for i, br := range branches {
+		names[i] = br.name
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+type branchFile struct {
+	name     string
+	modified time.Time
+}
+
+// list returns the branches in the directory containing the file, in no particular order.
+func (b *Branches) list() ([]branchFile, error) {
+	entries, err := os.ReadDir(filepath.Dir(b.path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(b.path) + "."
+	var branches []branchFile
+	for _, e := range entries {
+		fn := e.Name()
+		if e.IsDir() || len(fn) <= len(prefix)+len(branchSuffix) || !strings.HasPrefix(fn, prefix) || !strings.HasSuffix(fn, branchSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if os.IsNotExist(err) {
+			// Removed since the directory was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, branchFile{
+			name:     strings.TrimSuffix(strings.TrimPrefix(fn, prefix), branchSuffix),
+			modified: info.ModTime(),
+		})
+	}
+	return branches, nil
+}
+
+// prune removes the least recently saved branches other than keep until at most b.Max
+// are left.
+func (b *Branches) prune(keep string) error {
+	if b.Max <= 0 {
+		return nil
+	}
+	branches, err := b.list()
+	if err != nil {
+		return err
+	}
+	sort.Slice(branches, func(i, j int) bool {
+		if !branches[i].modified.Equal(branches[j].modified) {
+			return branches[i].modified.Before(branches[j].modified)
+		}
+		return branches[i].name < branches[j].name
+	})
+	left := len(branches)
+	for _, br := range branches {
+		if left <= b.Max {
+			break
+		}
+		if br.name == keep {
+			continue
+		}
+		if err = b.Remove(br.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		left--
+	}
+	return nil
+}
+
+// Save copies every frame of h to the branch called name, and then removes branches if
+// there are more than b.Max. If the branch already exists, the error satisfies os.IsExist
+// and nothing is written.
+func (b *Branches) Save(h *History, name string) error {
+	fn, err := b.filename(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = h.WriteTo(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fn)
+		return err
+	}
+	return b.prune(name)
+}
+
+// Load replaces the frames of h with those of the branch called name. The branch is not
+// removed.
+func (b *Branches) Load(h *History, name string) error {
+	fn, err := b.filename(name)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = h.ReadFrom(f)
+	return err
+}
+
+// Remove deletes the branch called name.
+func (b *Branches) Remove(name string) error {
+	fn, err := b.filename(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fn)
+}
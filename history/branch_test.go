@@ -0,0 +1,132 @@
+package history
+
+import (
+	"github.com/Rnoadm/rpg"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTruncate(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	h.KeyframeInterval = 3
+	frames := testFrames(t, h, 10)
+
+	expect(t, frames[4], nil, 4)(h.Seek(4, SeekStart))(h.Tell())
+	if err := h.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, nil, io.EOF, -1)(h.Seek(5, SeekStart))
+	frames = append(frames[:5], testFrames(t, h, 4)...)
+
+	testRandomSeeks(t, h, frames)
+	testRandomSeeks(t, NewHistory(f), frames)
+
+	h.Reset()
+	if err := h.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := h.Len(); err != nil || n != 0 {
+		t.Errorf("expected 0 frames, got %d (%v)", n, err)
+	}
+	testRandomSeeks(t, h, testFrames(t, h, 3))
+}
+
+type testNoTruncate struct {
+	io.ReadWriteSeeker
+}
+
+func TestTruncateUnsupported(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(testNoTruncate{f})
+	testFrames(t, h, 2)
+	if err := h.Truncate(); err != ErrTruncate {
+		t.Errorf("expected ErrTruncate, got %v", err)
+	}
+}
+
+func TestBranches(t *testing.T) {
+	dir, err := ioutil.TempDir(os.TempDir(), "testbranches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Glob metacharacters in the path are not special.
+	path := filepath.Join(dir, "game[1].sav")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	b := NewBranches(path)
+	h := NewHistory(f)
+	original := testFrames(t, h, 6)
+
+	if err = b.Save(h, "original"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Save(h, "original"); !os.IsExist(err) {
+		t.Errorf("expected an existing branch error, got %v", err)
+	}
+	if err = b.Save(h, "a/b"); err != ErrBranchName {
+		t.Errorf("expected ErrBranchName, got %v", err)
+	}
+
+	h.Seek(1, SeekStart)
+	if err = h.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	s := rpg.NewState()
+	if err = h.Append(s); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Save(h, "undone"); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, []string{"original", "undone"}) {
+		t.Errorf("unexpected branches: %q", names)
+	}
+
+	if err = b.Load(h, "original"); err != nil {
+		t.Fatal(err)
+	}
+	testRandomSeeks(t, h, original)
+
+	if err = b.Remove("original"); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ = b.List(); !reflect.DeepEqual(names, []string{"undone"}) {
+		t.Errorf("unexpected branches: %q", names)
+	}
+
+	// The branches saved least recently are removed to keep at most Max.
+	b.Max = 2
+	old := time.Now().Add(-time.Hour)
+	if err = os.Chtimes(path+".undone"+branchSuffix, old, old); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"c", "d"} {
+		if err = b.Save(h, name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if names, _ = b.List(); !reflect.DeepEqual(names, []string{"c", "d"}) {
+		t.Errorf("unexpected branches: %q", names)
+	}
+}
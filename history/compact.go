@@ -0,0 +1,99 @@
+package history
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrNotEmpty       = errors.New("history: destination of CompactTo is not empty")
+	ErrCompactChanged = errors.New("history: frames were removed or replaced during CompactTo")
+)
+
+// CompactOptions selects the frames kept by CompactTo. The zero value keeps every frame.
+// The last frame is always kept.
+type CompactOptions struct {
+	// Latest, if positive, drops every frame other than the last Latest frames.
+	Latest int64
+
+	// Before, if not zero, drops every frame with a Metadata.Time before it. Frames
+	// without a time are not dropped.
+	Before time.Time
+
+	// Every, if greater than one, keeps only every Every'th frame of those that are left,
+	// starting with the first.
+	Every int64
+}
+
+// keep returns the indices of the frames in index that are kept by opt.
+func (opt *CompactOptions) keep(index []record) []int64 {
+	n := int64(len(index))
+	start := int64(0)
+	if opt.Latest > 0 && opt.Latest < n {
+		start = n - opt.Latest
+	}
+
+	var keep []int64
+	for i := start; i < n; i++ {
+		if m := index[i].meta; !opt.Before.IsZero() && m != nil && !m.Time.IsZero() && m.Time.Before(opt.Before) && i != n-1 {
+			continue
+		}
+		keep = append(keep, i)
+	}
+
+	if opt.Every > 1 && len(keep) != 0 {
+		thinned := keep[:0]
+		for i, k := range keep {
+			if int64(i)%opt.Every == 0 || i == len(keep)-1 {
+				thinned = append(thinned, k)
+			}
+		}
+		keep = thinned
+	}
+	return keep
+}
+
+// CompactTo appends the frames of h that are kept by opt, along with their Metadata, to
+// dst, which must be empty. The frames are written using the KeyframeInterval and Compress
+// settings of dst, so CompactTo with the zero CompactOptions can be used to convert a file
+// written by an older version or to compress an existing file. The cursors of h are not
+// moved, and frames appended to h while CompactTo runs may be left out.
+func (h *History) CompactTo(dst *History, opt CompactOptions) error {
+	if n, err := dst.Len(); err != nil {
+		return err
+	} else if n != 0 {
+		return ErrNotEmpty
+	}
+
+	h.mtx.Lock()
+	if err := h.buildIndex(); err != nil {
+		h.mtx.Unlock()
+		return err
+	}
+	keep := opt.keep(h.index)
+	generation := h.generation
+	h.mtx.Unlock()
+
+	c := &Cursor{h: h, i: -1, generation: generation}
+	for _, i := range keep {
+		h.mtx.Lock()
+		if h.generation != generation {
+			h.mtx.Unlock()
+			return ErrCompactChanged
+		}
+		err := c.moveTo(i)
+		encoded, meta := c.b, h.index[i].meta
+		h.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+
+		dst.mtx.Lock()
+		err = dst.appendEncoded(encoded, meta)
+		dst.mtx.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
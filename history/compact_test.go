@@ -0,0 +1,105 @@
+package history
+
+import (
+	"github.com/Rnoadm/rpg"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCompress(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	h.KeyframeInterval = 5
+	frames := testFrames(t, h, 8)
+	h.Compress = true
+	frames = append(frames, testFrames(t, h, 8)...)
+
+	testRandomSeeks(t, h, frames)
+	testRandomSeeks(t, NewHistory(f), frames)
+	if removed, err := NewHistory(f).Recover(); err != nil || removed != 0 {
+		t.Errorf("Recover removed %d bytes (%v)", removed, err)
+	}
+}
+
+func TestCompactKeep(t *testing.T) {
+	index := make([]record, 10)
+	start := time.Date(2014, time.June, 1, 0, 0, 0, 0, time.UTC)
+	for i := range index {
+		if i != 2 {
+			index[i].meta = &Metadata{Time: start.Add(time.Duration(i) * time.Second)}
+		}
+	}
+
+	for _, test := range []struct {
+		opt  CompactOptions
+		keep []int64
+	}{
+		{CompactOptions{}, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{CompactOptions{Latest: 3}, []int64{7, 8, 9}},
+		{CompactOptions{Latest: 30}, []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{CompactOptions{Every: 4}, []int64{0, 4, 8, 9}},
+		{CompactOptions{Latest: 5, Every: 2}, []int64{5, 7, 9}},
+		{CompactOptions{Before: start.Add(4 * time.Second)}, []int64{2, 4, 5, 6, 7, 8, 9}},
+		{CompactOptions{Before: start.Add(time.Hour)}, []int64{2, 9}},
+	} {
+		if keep := test.opt.keep(index); !reflect.DeepEqual(keep, test.keep) {
+			t.Errorf("%+v: expected %v, got %v", test.opt, test.keep, keep)
+		}
+	}
+}
+
+func TestCompactTo(t *testing.T) {
+	src, cleanupSrc := testFile(t)
+	defer cleanupSrc()
+	dst, cleanupDst := testFile(t)
+	defer cleanupDst()
+
+	h := NewHistory(src)
+	h.KeyframeInterval = 1000
+	var frames [][]byte
+	s := rpg.NewState()
+	for i := 0; i < 30; i++ {
+		s.Atomic(func(s *rpg.State) bool {
+			s.Create(rpg.ResourcesFactory)
+			return true
+		})
+		if err := h.AppendWithMetadata(s, &Metadata{Label: "create", Args: []string{string(rune('a' + i))}}); err != nil {
+			t.Fatal(err)
+		}
+		b, err := s.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, b)
+	}
+
+	c := NewHistory(dst)
+	c.KeyframeInterval = 4
+	c.Compress = true
+	if err := h.CompactTo(c, CompactOptions{Latest: 20, Every: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.CompactTo(c, CompactOptions{}); err != ErrNotEmpty {
+		t.Errorf("expected ErrNotEmpty, got %v", err)
+	}
+
+	var kept [][]byte
+	for i := 10; i < 30; i += 3 {
+		kept = append(kept, frames[i])
+	}
+	kept = append(kept, frames[29])
+	testRandomSeeks(t, NewHistory(dst), kept)
+
+	if m, err := c.Metadata(1); err != nil || m.Args[0] != "n" {
+		t.Errorf("unexpected metadata %v (%v)", m, err)
+	}
+
+	srcSize, _ := src.Seek(0, SeekEnd)
+	dstSize, _ := dst.Seek(0, SeekEnd)
+	if dstSize >= srcSize {
+		t.Errorf("compacted file is %d bytes, but the original is %d bytes", dstSize, srcSize)
+	}
+}
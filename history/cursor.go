@@ -0,0 +1,195 @@
+package history
+
+import (
+	"bytes"
+	"encoding/gob"
+	"github.com/BenLubar/bindiff"
+	"github.com/Rnoadm/rpg"
+	"io"
+	"time"
+)
+
+// Cursor is a position in a History that can be moved independently of the History's own
+// position, such as to watch a game while it is being played. It sees frames as soon as
+// they are appended.
+type Cursor struct {
+	h *History
+	i int64
+	b []byte
+
+	// generation is compared with h.generation to find out if the frames have changed.
+	generation uint64
+}
+
+// SeekFrame moves the cursor to an offset from the start, end, or current position and
+// returns the value at the cursor. If the error returned is io.EOF, SeekFrame was asked to
+// pass the start or end of the file and the cursor was not moved. Any other non-nil error
+// means that History is no longer safe to use.
+func (c *Cursor) SeekFrame(offset int64, whence int) (*rpg.State, error) {
+	c.h.mtx.Lock()
+
+	if err := c.h.buildIndex(); err != nil {
+		c.h.mtx.Unlock()
+		return nil, err
+	}
+	c.sync()
+
+	n := int64(len(c.h.index))
+	var target int64
+	switch {
+	case whence == SeekStart:
+		target = offset
+	case whence == SeekEnd:
+		target = n - 1 + offset
+	case c.i < 0 && offset > 0:
+		// -1 is before the start.
+		target = offset - 1
+	case c.i < 0:
+		// -1 is after the end.
+		target = n + offset
+	default:
+		target = c.i + offset
+	}
+
+	err := c.seek(target)
+	c.h.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.decode()
+}
+
+// SeekTime moves the cursor to the last frame with a Metadata.Time at or before t and
+// returns the value at the cursor. Frames without Metadata or with a zero Time are
+// skipped. If there is no such frame, io.EOF is returned and the cursor is not moved.
+func (c *Cursor) SeekTime(t time.Time) (*rpg.State, error) {
+	c.h.mtx.Lock()
+
+	if err := c.h.buildIndex(); err != nil {
+		c.h.mtx.Unlock()
+		return nil, err
+	}
+	c.sync()
+
+	target := int64(-1)
+	for i := int64(len(c.h.index)) - 1; i >= 0; i-- {
+		m := c.h.index[i].meta
+		if m != nil && !m.Time.IsZero() && !m.Time.After(t) {
+			target = i
+			break
+		}
+	}
+
+	err := c.seek(target)
+	c.h.mtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return c.decode()
+}
+
+// seek moves the cursor to target, or returns io.EOF if there is no such frame.
+func (c *Cursor) seek(target int64) error {
+	if target < 0 || target >= int64(len(c.h.index)) {
+		return io.EOF
+	}
+	if err := c.moveTo(target); err != nil {
+		c.Reset()
+		return err
+	}
+	return nil
+}
+
+// sync resets the cursor if the frames of the History were removed or replaced since it
+// last moved.
+func (c *Cursor) sync() {
+	if c.generation != c.h.generation {
+		c.i, c.b = -1, nil
+		c.generation = c.h.generation
+	}
+}
+
+func (c *Cursor) decode() (*rpg.State, error) {
+	s := rpg.NewStateWithRegistry(c.h.r)
+	err := gob.NewDecoder(bytes.NewReader(c.b)).Decode(&s)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return s, err
+}
+
+// moveTo moves the cursor to frame target by the shortest route: patching from the
+// current frame, or loading the nearest keyframe at or before target and patching from
+// there. The caller must hold c.h.mtx.
+func (c *Cursor) moveTo(target int64) error {
+	h := c.h
+
+	k := target
+	for k >= 0 && !h.index[k].keyframe {
+		k--
+	}
+
+	// The cost is the number of records read. Starting from nothing is the same as
+	// loading a keyframe at -1 without reading it.
+	keyframeCost := target - k
+	if k >= 0 {
+		keyframeCost++
+	}
+	currentCost := keyframeCost + 1
+	if c.i >= 0 {
+		currentCost = target - c.i
+		if currentCost < 0 {
+			currentCost = -currentCost
+		}
+	}
+
+	if keyframeCost < currentCost {
+		if k < 0 {
+			c.i, c.b = -1, nil
+		} else {
+			_, snapshot, err := h.payload(k)
+			if err != nil {
+				return err
+			}
+			c.i, c.b = k, snapshot
+		}
+	}
+
+	for c.i < target {
+		patch, _, err := h.payload(c.i + 1)
+		if err != nil {
+			return err
+		}
+		b, err := bindiff.Forward(c.b, patch)
+		if err != nil {
+			return err
+		}
+		c.i, c.b = c.i+1, b
+	}
+	for c.i > target {
+		patch, _, err := h.payload(c.i)
+		if err != nil {
+			return err
+		}
+		b, err := bindiff.Reverse(c.b, patch)
+		if err != nil {
+			return err
+		}
+		c.i, c.b = c.i-1, b
+	}
+
+	return nil
+}
+
+// Tell returns the current position of the cursor. -1 is a special state that is either
+// before the start or after the end, depending on the direction of the next SeekFrame.
+func (c *Cursor) Tell() int64 {
+	return c.i
+}
+
+// Reset sets the cursor to position -1, equivalent to creating a new Cursor.
+func (c *Cursor) Reset() {
+	c.i, c.b = -1, nil
+}
@@ -0,0 +1,116 @@
+package history
+
+import (
+	"bytes"
+	"github.com/Rnoadm/rpg"
+	"io"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+func TestCursorConcurrent(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	const count = 200
+
+	// Build the frames first so the readers know what to expect.
+	var states []*rpg.State
+	var frames [][]byte
+	s := rpg.NewState()
+	for i := 0; i < count; i++ {
+		s.Atomic(func(s *rpg.State) bool {
+			_, o := s.Create(rpg.ResourcesFactory)
+			o.Component(rpg.ResourcesType).(*rpg.Resources).Set("frame", int64(i))
+			return true
+		})
+		b, err := s.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := rpg.NewState()
+		if err = c.GobDecode(b); err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, c)
+		frames = append(frames, b)
+	}
+
+	h := NewHistory(f)
+	h.KeyframeInterval = 16
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+
+			c := h.NewCursor()
+			rnd := rand.New(rand.NewSource(seed))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				n, err := h.Len()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if n == 0 {
+					continue
+				}
+				target := rnd.Int63n(n)
+				s, err := c.SeekFrame(target, SeekStart)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				b, err := s.GobEncode()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if c.Tell() != target || !bytes.Equal(b, frames[target]) {
+					t.Errorf("cursor at %d does not match frame %d", c.Tell(), target)
+					return
+				}
+			}
+		}(int64(r))
+	}
+
+	for _, s := range states {
+		if err := h.Append(s); err != nil {
+			t.Error(err)
+			break
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	testRandomSeeks(t, h, frames)
+}
+
+func TestCursorTruncate(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	frames := testFrames(t, h, 5)
+
+	c := h.NewCursor()
+	expect(t, frames[4], nil, 4)(c.SeekFrame(4, SeekStart))(c.Tell())
+	expect(t, frames[1], nil, 1)(h.Seek(1, SeekStart))(h.Tell())
+	if err := h.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cursor was reset, so it starts again from the end.
+	expect(t, frames[1], nil, 1)(c.SeekFrame(-1, SeekCur))(c.Tell())
+	expect(t, nil, io.EOF, 1)(c.SeekFrame(1, SeekCur))(c.Tell())
+	expect(t, frames[1], nil, 1)(h.Seek(0, SeekCur))(h.Tell())
+}
@@ -1,13 +1,34 @@
 // Package history provides a seekable sequence of rpg.State.
+//
+// A history file starts with a header followed by one record per frame. Each record is
+// the size of its payload as a little-endian int64, the payload, and the size again, so
+// the file can be read in either direction. The payload starts with a byte of flags,
+// followed by the frame's Metadata, if it has any, and a bindiff patch from the previous
+// frame. Keyframes additionally contain the entire encoded State, so a frame can be found
+// by loading the nearest keyframe before it and applying a bounded number of patches. The
+// patch and the State may be compressed together with DEFLATE. The payload ends with a
+// CRC-32 (Castagnoli) of the rest of it, so Recover can tell a complete record from one
+// that was torn by a crash.
+//
+// Files written before the header was introduced contain only patches. They can still be
+// read and appended to, but every Seek that starts from scratch replays them from the
+// first frame.
 package history
 
 import (
 	"bytes"
+	"compress/flate"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"github.com/BenLubar/bindiff"
 	"github.com/Rnoadm/rpg"
+	"hash/crc32"
 	"io"
+	"io/ioutil"
+	"sync"
+	"time"
 )
 
 // See also: io.Seeker
@@ -19,191 +40,728 @@ const (
 
 const sizeof_int64 = 64 / 8
 
-// History is a seekable sequence of rpg.State.
+// magic is the header of a history file. Read as the size of a legacy record, it would be
+// far larger than any real patch.
+const magic = "\x00rpghist"
+
+// DefaultKeyframeInterval is the number of frames between keyframes when
+// History.KeyframeInterval is zero.
+const DefaultKeyframeInterval = 100
+
+const (
+	flagKeyframe = 1 << iota
+	flagMetadata
+	flagChecksum
+	flagCompressed
+
+	knownFlags = flagKeyframe | flagMetadata | flagChecksum | flagCompressed
+)
+
+var (
+	ErrCorrupt      = errors.New("history: record is corrupt")
+	ErrUnknownFlags = errors.New("history: record has unknown flags")
+	ErrTruncate     = errors.New("history: file cannot be truncated")
+	ErrChecksum     = errors.New("history: record checksum does not match")
+	ErrKeyframe     = errors.New("history: keyframe does not match the frames before it")
+)
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// truncater and syncer are implemented by *os.File.
+type truncater interface {
+	Truncate(size int64) error
+}
+
+type syncer interface {
+	Sync() error
+}
+
+// History is a seekable sequence of rpg.State. It has its own Cursor, which is moved by
+// Append, and any number of others can be created with NewCursor. The methods of History
+// and its Cursors are safe to call from multiple goroutines, but each Cursor, including
+// the one belonging to History, should only be used by one goroutine at a time.
+// KeyframeInterval and Sync must not be changed while other goroutines use the History.
 type History struct {
-	i int64
-	b []byte
-	f io.ReadWriteSeeker
+	// KeyframeInterval is the number of frames between keyframes written by Append.
+	// Zero means DefaultKeyframeInterval.
+	KeyframeInterval int
+
+	// Sync makes Append call the Sync method of the io.ReadWriteSeeker passed to
+	// NewHistory, if it has one, as *os.File does, so that each frame is on disk before
+	// Append returns.
+	Sync bool
+
+	// Compress makes Append compress each record. Files may contain both compressed and
+	// uncompressed records.
+	Compress bool
+
+	cursor Cursor
+	f      io.ReadWriteSeeker
+	r      *rpg.Registry
+
+	// mtx protects the file and everything below it.
+	mtx sync.Mutex
+
+	// generation is increased when frames are removed or replaced, which resets every
+	// Cursor other than h.cursor.
+	generation uint64
+
+	// index is built by reading the file the first time it is needed.
+	indexed bool
+	legacy  bool
+	base    int64
+	index   []record
+}
+
+// record is the location of a frame in the file.
+type record struct {
+	offset   int64 // of the leading size
+	size     int64
+	keyframe bool
+	meta     *Metadata
+}
+
+func (r record) end() int64 {
+	return r.offset + sizeof_int64 + r.size + sizeof_int64
 }
 
 // NewHistory returns a new History that reads from and writes to f.
 func NewHistory(f io.ReadWriteSeeker) *History {
-	return &History{f: f, i: -1}
+	return NewHistoryWithRegistry(f, nil)
+}
+
+// NewHistoryWithRegistry is the same as NewHistory, but the States returned by Seek use r.
+func NewHistoryWithRegistry(f io.ReadWriteSeeker, r *rpg.Registry) *History {
+	h := &History{f: f, r: r}
+	h.cursor = Cursor{h: h, i: -1}
+	return h
 }
 
-// Seek moves the cursor to an offset from the start, end, or current position and returns
-// the value at the cursor. If the error returned is io.EOF, Seek was asked to pass the start
-// or end of the file. Any other non-nil error means that History is no longer safe to use.
+// Seek calls SeekFrame on the Cursor of h.
 func (h *History) Seek(offset int64, whence int) (*rpg.State, error) {
-	if whence == SeekCur && h.i < 0 {
-		if offset > 0 {
-			offset--
-		} else {
-			offset++
-			whence = SeekEnd
-		}
+	return h.cursor.SeekFrame(offset, whence)
+}
+
+// SeekTime calls SeekTime on the Cursor of h.
+func (h *History) SeekTime(t time.Time) (*rpg.State, error) {
+	return h.cursor.SeekTime(t)
+}
+
+// Tell calls Tell on the Cursor of h.
+func (h *History) Tell() int64 {
+	return h.cursor.Tell()
+}
+
+// Reset calls Reset on the Cursor of h.
+func (h *History) Reset() {
+	h.cursor.Reset()
+}
+
+// NewCursor returns a new Cursor at position -1 that reads from h.
+func (h *History) NewCursor() *Cursor {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return &Cursor{h: h, i: -1, generation: h.generation}
+}
+
+// invalidate resets every Cursor other than the one belonging to h. The caller must hold
+// h.mtx.
+func (h *History) invalidate() {
+	h.generation++
+	h.cursor.generation = h.generation
+}
+
+// Len returns the number of frames in h.
+func (h *History) Len() (int64, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if err := h.buildIndex(); err != nil {
+		return 0, err
+	}
+	return int64(len(h.index)), nil
+}
+
+// buildIndex reads the header and the size and flags of every record in the file. The
+// patches and snapshots are not read. The caller must hold h.mtx, as for every unexported
+// method of History.
+func (h *History) buildIndex() error {
+	if h.indexed {
+		return nil
+	}
+
+	if _, err := h.scan(false); err != nil {
+		return err
+	}
+
+	h.indexed = true
+	return nil
+}
+
+// scan reads the header and the record headers into h.index until the end of the file or
+// an error, returning the offset of the end of the last record that was read successfully.
+// If verify is true, every record is read in full and its checksum is verified.
+func (h *History) scan(verify bool) (int64, error) {
+	if _, err := h.f.Seek(0, SeekStart); err != nil {
+		return 0, err
 	}
-	if whence == SeekStart || h.i < 0 {
-		if _, err := h.f.Seek(0, SeekStart); err != nil {
-			return nil, err
+	var header [len(magic)]byte
+	_, err := io.ReadFull(h.f, header[:])
+	switch {
+	case err == io.EOF:
+		// The header is written along with the first record.
+		h.legacy = false
+	case err == io.ErrUnexpectedEOF || (err == nil && string(header[:]) != magic):
+		h.legacy = true
+	case err != nil:
+		return 0, err
+	default:
+		h.legacy = false
+	}
+	h.base = int64(len(magic))
+	if h.legacy {
+		h.base = 0
+	}
+
+	h.index = h.index[:0]
+	offset := h.base
+	for {
+		r, err := h.readHeader(offset, verify)
+		if err == io.EOF {
+			return offset, nil
 		}
-		h.i, h.b = -1, nil
-		if err := h.seekForward(); err != nil {
-			return nil, err
+		if err != nil {
+			return offset, err
 		}
+		h.index = append(h.index, r)
+		offset = r.end()
 	}
-	if whence == SeekEnd {
-		for {
-			err := h.seekForward()
-			if err == io.EOF {
-				break
-			}
+}
+
+// readHeader reads the sizes and flags of the record at offset. It returns io.EOF if
+// offset is the end of the file. If verify is true, the entire payload is read and its
+// checksum is verified.
+func (h *History) readHeader(offset int64, verify bool) (record, error) {
+	r := record{offset: offset}
+
+	if _, err := h.f.Seek(offset, SeekStart); err != nil {
+		return r, err
+	}
+	if err := binary.Read(h.f, binary.LittleEndian, &r.size); err != nil {
+		return r, err
+	}
+	if r.size < 0 || (!h.legacy && r.size == 0) {
+		return r, ErrCorrupt
+	}
+
+	// The trailing size is checked first, as it is the last part of a record to be written.
+	if _, err := h.f.Seek(offset+sizeof_int64+r.size, SeekStart); err != nil {
+		return r, err
+	}
+	var size int64
+	if err := binary.Read(h.f, binary.LittleEndian, &size); err != nil {
+		return r, unexpected(err)
+	}
+	if size != r.size {
+		return r, ErrCorrupt
+	}
+
+	if h.legacy {
+		return r, nil
+	}
+
+	if _, err := h.f.Seek(offset+sizeof_int64, SeekStart); err != nil {
+		return r, err
+	}
+	var flags byte
+	var meta []byte
+	if verify {
+		data := make([]byte, r.size)
+		if _, err := io.ReadFull(h.f, data); err != nil {
+			return r, unexpected(err)
+		}
+		var err error
+		if flags, meta, _, _, err = parsePayload(data); err != nil {
+			return r, err
+		}
+	} else {
+		var b [1]byte
+		if _, err := io.ReadFull(h.f, b[:]); err != nil {
+			return r, unexpected(err)
+		}
+		flags = b[0]
+		if flags&^knownFlags != 0 {
+			return r, ErrUnknownFlags
+		}
+		if flags&flagMetadata != 0 {
+			l, err := binary.ReadUvarint(byteReader{h.f})
 			if err != nil {
-				return nil, err
+				return r, unexpected(err)
+			}
+			if l >= uint64(r.size) {
+				return r, ErrCorrupt
+			}
+			meta = make([]byte, l)
+			if _, err = io.ReadFull(h.f, meta); err != nil {
+				return r, unexpected(err)
 			}
 		}
 	}
-	for offset > 0 {
-		if err := h.seekForward(); err != nil {
-			return nil, err
+
+	r.keyframe = flags&flagKeyframe != 0
+	if flags&flagMetadata != 0 {
+		var err error
+		if r.meta, err = decodeMetadata(meta); err != nil {
+			return r, err
 		}
-		offset--
 	}
-	for offset < 0 {
-		if err := h.seekReverse(); err != nil {
-			return nil, err
-		}
-		offset++
+
+	return r, nil
+}
+
+// payload reads the patch and, for keyframes, the snapshot of frame i.
+func (h *History) payload(i int64) (patch, snapshot []byte, err error) {
+	r := h.index[i]
+	if _, err = h.f.Seek(r.offset+sizeof_int64, SeekStart); err != nil {
+		return
+	}
+	data := make([]byte, r.size)
+	if _, err = io.ReadFull(h.f, data); err != nil {
+		err = unexpected(err)
+		return
 	}
 
-	var s *rpg.State
-	err := gob.NewDecoder(bytes.NewReader(h.b)).Decode(&s)
-	if err == io.EOF {
-		err = io.ErrUnexpectedEOF
+	if h.legacy {
+		return data, nil, nil
 	}
-	return s, err
+
+	_, _, patch, snapshot, err = parsePayload(data)
+	return
 }
 
-func (h *History) seekForward() error {
-	var size int64
-	err := binary.Read(h.f, binary.LittleEndian, &size)
-	if err != nil {
-		return err
+// parsePayload splits the payload of a record that is not in a legacy file and verifies
+// its checksum, if it has one. snapshot is nil unless the record is a keyframe.
+func parsePayload(data []byte) (flags byte, meta, patch, snapshot []byte, err error) {
+	if len(data) == 0 {
+		err = ErrCorrupt
+		return
+	}
+	flags = data[0]
+	if flags&^knownFlags != 0 {
+		err = ErrUnknownFlags
+		return
+	}
+	if flags&flagChecksum != 0 {
+		if len(data) < 1+crc32.Size {
+			err = ErrCorrupt
+			return
+		}
+		sum := binary.LittleEndian.Uint32(data[len(data)-crc32.Size:])
+		data = data[:len(data)-crc32.Size]
+		if crc32.Checksum(data, checksumTable) != sum {
+			err = ErrChecksum
+			return
+		}
 	}
 
-	patch := make([]byte, size+sizeof_int64)
-	_, err = io.ReadFull(h.f, patch)
-	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+	data = data[1:]
+	if flags&flagMetadata != 0 {
+		if meta, data, err = readBytes(data); err != nil {
+			return
 		}
-		return err
 	}
+	if flags&flagCompressed != 0 {
+		if data, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(data))); err != nil {
+			err = unexpected(err)
+			return
+		}
+	}
+	if patch, data, err = readBytes(data); err != nil {
+		return
+	}
+	if flags&flagKeyframe != 0 {
+		snapshot = data
+	} else if len(data) != 0 {
+		err = ErrCorrupt
+	}
+	return
+}
 
-	h.i++
+// Append adds s to the end of h and moves the cursor to it. The record is written with a
+// single Write, and if it fails, Append removes whatever part of it was written, so the
+// error does not make h unsafe to use unless the file cannot be truncated. A record left
+// incomplete by a crash is removed by Recover.
+func (h *History) Append(s *rpg.State) error {
+	return h.AppendWithMetadata(s, nil)
+}
 
-	h.b, err = bindiff.Forward(h.b, patch[:size])
+// AppendWithMetadata is the same as Append, but the frame is described by m, which may be
+// nil. Files written before Metadata was introduced cannot store it, so ErrLegacy is
+// returned without appending if m is not nil. ErrLegacy does not make h unsafe to use.
+func (h *History) AppendWithMetadata(s *rpg.State, m *Metadata) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		return err
+	}
 
-	return err
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return h.appendEncoded(buf.Bytes(), m)
 }
 
-func (h *History) seekReverse() error {
-	if h.i == 0 {
-		return io.EOF
+// appendEncoded appends a frame that has already been encoded.
+func (h *History) appendEncoded(encoded []byte, m *Metadata) error {
+	if err := h.buildIndex(); err != nil {
+		return err
+	}
+	if m != nil && h.legacy {
+		return ErrLegacy
 	}
 
-	_, err := h.f.Seek(-sizeof_int64, SeekCur)
-	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+	var meta []byte
+	if m != nil {
+		var err error
+		if meta, err = m.encode(); err != nil {
+			return err
 		}
-		return err
+		// Keep a copy so later changes to m do not affect the index.
+		m = &Metadata{m.Time, m.Actor, m.Label, append([]string(nil), m.Args...)}
 	}
 
-	var size int64
-	err = binary.Read(h.f, binary.LittleEndian, &size)
-	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+	c := &h.cursor
+	n := int64(len(h.index))
+	if n != 0 && c.i != n-1 {
+		if err := c.moveTo(n - 1); err != nil {
+			c.Reset()
+			return err
 		}
-		return err
 	}
 
-	_, err = h.f.Seek(-size-sizeof_int64, SeekCur)
-	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+	interval := int64(h.KeyframeInterval)
+	if interval <= 0 {
+		interval = DefaultKeyframeInterval
+	}
+
+	patch := bindiff.Diff(c.b, encoded, 10)
+	r := record{offset: h.base, keyframe: !h.legacy && n%interval == 0, meta: m}
+	if n != 0 {
+		r.offset = h.index[n-1].end()
+	}
+
+	var payload []byte
+	if h.legacy {
+		payload = patch
+	} else {
+		flags := byte(flagChecksum)
+		if r.keyframe {
+			flags |= flagKeyframe
 		}
-		return err
+		if m != nil {
+			flags |= flagMetadata
+		}
+		body := writeBytes(nil, patch)
+		if r.keyframe {
+			body = append(body, encoded...)
+		}
+		if h.Compress {
+			flags |= flagCompressed
+			var buf bytes.Buffer
+			w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+			if err != nil {
+				return err
+			}
+			if _, err = w.Write(body); err != nil {
+				return err
+			}
+			if err = w.Close(); err != nil {
+				return err
+			}
+			body = buf.Bytes()
+		}
+		payload = append(payload, flags)
+		if m != nil {
+			payload = writeBytes(payload, meta)
+		}
+		payload = append(payload, body...)
+		var sum [crc32.Size]byte
+		binary.LittleEndian.PutUint32(sum[:], crc32.Checksum(payload, checksumTable))
+		payload = append(payload, sum[:]...)
 	}
+	r.size = int64(len(payload))
 
-	patch := make([]byte, size+sizeof_int64)
-	_, err = io.ReadFull(h.f, patch)
+	// The record is written all at once, along with the header if this is the first.
+	start := r.offset
+	var data []byte
+	if n == 0 && !h.legacy {
+		start = 0
+		data = append(data, magic...)
+	}
+	var size [sizeof_int64]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(r.size))
+	data = append(data, size[:]...)
+	data = append(data, payload...)
+	data = append(data, size[:]...)
+
+	if _, err := h.f.Seek(start, SeekStart); err != nil {
+		return err
+	}
+	written, err := h.f.Write(data)
+	if err == nil && written != len(data) {
+		err = io.ErrShortWrite
+	}
 	if err != nil {
-		if err == io.EOF {
-			err = io.ErrUnexpectedEOF
+		if t, ok := h.f.(truncater); ok && written != 0 {
+			if t.Truncate(start) != nil {
+				h.indexed = false
+				h.invalidate()
+			}
 		}
 		return err
 	}
 
-	h.i--
+	h.index = append(h.index, r)
+	c.i, c.b = n, encoded
 
-	h.b, err = bindiff.Reverse(h.b, patch[:size])
+	if h.Sync {
+		if s, ok := h.f.(syncer); ok {
+			return s.Sync()
+		}
+	}
 
-	return err
+	return nil
 }
 
-// Append adds s to the end of h. h.Seek(0, SeekEnd) is called before writing. A non-nil
-// error means that h is no longer safe to use.
-func (h *History) Append(s *rpg.State) error {
-	_, err := h.Seek(0, SeekEnd)
-	if err == io.EOF && h.i == -1 {
-		err = nil
+// Recover reads every record in the file and verifies its checksum. If the file ends with
+// an incomplete or corrupt record, such as one left by a crash during Append, the file is
+// truncated to the end of the last valid record and the number of bytes that were removed
+// is returned. If a valid record follows the invalid one, the damage is not a torn tail,
+// so the file is left alone and a *FrameError is returned. Records written by older
+// versions, which have no checksum, are only checked for completeness. Recover requires
+// the io.ReadWriteSeeker passed to NewHistory to have a Truncate method, and it resets
+// every Cursor.
+func (h *History) Recover() (int64, error) {
+	t, ok := h.f.(truncater)
+	if !ok {
+		return 0, ErrTruncate
 	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.invalidate()
+	h.cursor.Reset()
+	h.indexed = false
+	size, err := h.f.Seek(0, SeekEnd)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	var buf bytes.Buffer
-	err = gob.NewEncoder(&buf).Encode(s)
-	if err != nil {
-		return err
+	end, err := h.scan(true)
+	switch err {
+	case nil:
+		h.indexed = true
+		return 0, nil
+	case ErrCorrupt, ErrChecksum, io.ErrUnexpectedEOF:
+	default:
+		return 0, err
 	}
 
-	patch := bindiff.Diff(h.b, buf.Bytes(), 10)
+	if after, ferr := h.validAfter(end, size); ferr != nil {
+		return 0, ferr
+	} else if after {
+		return 0, &FrameError{Frame: int64(len(h.index)), Err: err}
+	}
 
-	h.i++
-	h.b = buf.Bytes()
+	if len(h.index) == 0 {
+		// Nothing is left but the header, which is written again by the next Append.
+		end = 0
+		h.legacy, h.base = false, int64(len(magic))
+	}
+	if err = t.Truncate(end); err != nil {
+		return 0, err
+	}
+	h.indexed = true
+	return size - end, nil
+}
 
-	err = binary.Write(h.f, binary.LittleEndian, int64(len(patch)))
-	if err != nil {
-		return err
+// validAfter returns true if a valid record starts anywhere after offset and ends by size.
+func (h *History) validAfter(offset, size int64) (bool, error) {
+	for p := offset + 1; p+2*sizeof_int64 <= size; p++ {
+		// Sizes that run past the end of the file are skipped without seeking to them.
+		if _, err := h.f.Seek(p, SeekStart); err != nil {
+			return false, err
+		}
+		var n int64
+		if err := binary.Read(h.f, binary.LittleEndian, &n); err != nil {
+			return false, err
+		}
+		if n < 0 || n > size-p-2*sizeof_int64 {
+			continue
+		}
+		if _, err := h.readHeader(p, true); err == nil {
+			return true, nil
+		}
 	}
+	return false, nil
+}
 
-	n, err := h.f.Write(patch)
-	if err != nil {
+// FrameError is returned by Verify and Recover when a frame is invalid.
+type FrameError struct {
+	Frame int64
+	Err   error
+}
+
+func (err *FrameError) Error() string {
+	return fmt.Sprintf("history: frame %d: %v", err.Frame, err.Err)
+}
+
+// Verify reads every record in the file, checking its checksum, and applies every patch
+// from the first frame to the last, checking that each keyframe matches the frame that
+// the patches before it produce. The States are not decoded. If a frame is invalid, a
+// *FrameError is returned. Verify does not move any Cursor.
+func (h *History) Verify() error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.indexed = false
+	if _, err := h.scan(true); err != nil {
+		if err == ErrCorrupt || err == ErrChecksum || err == io.ErrUnexpectedEOF || err == ErrUnknownFlags {
+			return &FrameError{Frame: int64(len(h.index)), Err: err}
+		}
 		return err
 	}
-	if n != len(patch) {
-		return io.ErrShortWrite
+	h.indexed = true
+
+	var b []byte
+	for i := range h.index {
+		patch, snapshot, err := h.payload(int64(i))
+		if err == nil {
+			b, err = bindiff.Forward(b, patch)
+		}
+		if err == nil && h.index[i].keyframe && !bytes.Equal(b, snapshot) {
+			err = ErrKeyframe
+		}
+		if err != nil {
+			return &FrameError{Frame: int64(i), Err: err}
+		}
+	}
+	return nil
+}
+
+// Metadata returns the Metadata of frame i, or nil if it has none.
+func (h *History) Metadata(i int64) (*Metadata, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if err := h.buildIndex(); err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= int64(len(h.index)) {
+		return nil, io.EOF
 	}
+	return h.index[i].meta, nil
+}
 
-	err = binary.Write(h.f, binary.LittleEndian, int64(len(patch)))
-	if err != nil {
+// Frames describes every frame in h, in order.
+func (h *History) Frames() ([]FrameInfo, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if err := h.buildIndex(); err != nil {
+		return nil, err
+	}
+	frames := make([]FrameInfo, len(h.index))
+	for i, r := range h.index {
+		frames[i] = FrameInfo{
+			Index:    int64(i),
+			Size:     r.end() - r.offset,
+			Keyframe: r.keyframe,
+			Metadata: r.meta,
+		}
+	}
+	return frames, nil
+}
+
+// Truncate removes every frame after the Cursor of h, so the next Append follows the frame
+// at the cursor. If the cursor is at -1, every frame is removed. Every other Cursor is
+// reset. The io.ReadWriteSeeker passed to NewHistory must have a Truncate method, as
+// *os.File does, or ErrTruncate is returned. A non-nil error other than ErrTruncate means
+// that h is no longer safe to use.
+func (h *History) Truncate() error {
+	t, ok := h.f.(truncater)
+	if !ok {
+		return ErrTruncate
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if err := h.buildIndex(); err != nil {
 		return err
 	}
 
+	n := h.cursor.i + 1
+	var size int64
+	if n != 0 {
+		size = h.index[n-1].end()
+	}
+	if err := t.Truncate(size); err != nil {
+		return err
+	}
+	h.index = h.index[:n]
+	h.invalidate()
+	if n == 0 {
+		// The file is empty, so the next Append writes a header.
+		h.legacy, h.base = false, int64(len(magic))
+	}
 	return nil
 }
 
-// Tell returns the current position of this History's cursor. -1 is a special state that
-// is either before the start or after the end, depending on the direction of the next Seek.
-func (h *History) Tell() int64 {
-	return h.i
+// WriteTo implements io.WriterTo. It copies the entire file, including frames after the
+// cursor, to w.
+func (h *History) WriteTo(w io.Writer) (int64, error) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if _, err := h.f.Seek(0, SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, h.f)
 }
 
-// Reset sets the cursor to position -1, equivalent to calling NewHistory on the same
-// io.ReadWriteSeeker.
-func (h *History) Reset() {
-	h.i, h.b = -1, nil
+// ReadFrom implements io.ReaderFrom. It replaces the entire file with a history file read
+// from r, such as one written by WriteTo, and resets every Cursor. Like Truncate, it requires
+// the io.ReadWriteSeeker passed to NewHistory to have a Truncate method.
+func (h *History) ReadFrom(r io.Reader) (int64, error) {
+	t, ok := h.f.(truncater)
+	if !ok {
+		return 0, ErrTruncate
+	}
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.invalidate()
+	h.cursor.Reset()
+	h.indexed, h.index = false, nil
+	if err := t.Truncate(0); err != nil {
+		return 0, err
+	}
+	if _, err := h.f.Seek(0, SeekStart); err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(h.f, r)
+	if err != nil {
+		return n, err
+	}
+	return n, h.buildIndex()
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
@@ -9,19 +9,24 @@ import (
 	"testing"
 )
 
-func testSetup0(t *testing.T) (*History, func()) {
+func testFile(t *testing.T) (*os.File, func()) {
 	f, err := ioutil.TempFile(os.TempDir(), "testhistory")
 	if err != nil {
 		t.Error(err)
 		t.SkipNow()
 	}
-	return NewHistory(f), func() {
+	return f, func() {
 		n := f.Name()
 		f.Close()
 		os.Remove(n)
 	}
 }
 
+func testSetup0(t *testing.T) (*History, func()) {
+	f, cleanup := testFile(t)
+	return NewHistory(f), cleanup
+}
+
 func testSetup1(t *testing.T) (*History, []byte, func()) {
 	h, cleanup := testSetup0(t)
 
@@ -0,0 +1,116 @@
+package history
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"github.com/BenLubar/bindiff"
+	"github.com/Rnoadm/rpg"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// testFrames appends count frames to h, each adding an Object to the previous one, and
+// returns their encodings.
+func testFrames(t *testing.T, h *History, count int) [][]byte {
+	s := rpg.NewState()
+	var frames [][]byte
+	for i := 0; i < count; i++ {
+		s.Atomic(func(s *rpg.State) bool {
+			_, o := s.Create(rpg.ResourcesFactory)
+			o.Component(rpg.ResourcesType).(*rpg.Resources).Set("frame", int64(i))
+			return true
+		})
+		if err := h.Append(s); err != nil {
+			t.Fatal(err)
+		}
+		b, err := s.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, b)
+	}
+	return frames
+}
+
+func testRandomSeeks(t *testing.T, h *History, frames [][]byte) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		target := r.Int63n(int64(len(frames)))
+		expect(t, frames[target], nil, target)(h.Seek(target, SeekStart))(h.Tell())
+	}
+	expect(t, nil, io.EOF, -1)(h.Seek(int64(len(frames)), SeekStart))
+	expect(t, frames[len(frames)-1], nil, int64(len(frames)-1))(h.Seek(0, SeekEnd))(h.Tell())
+	expect(t, frames[len(frames)-2], nil, int64(len(frames)-2))(h.Seek(-1, SeekCur))(h.Tell())
+}
+
+func TestKeyframes(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	h.KeyframeInterval = 7
+	frames := testFrames(t, h, 50)
+	testRandomSeeks(t, h, frames)
+
+	// A new History builds its index from the file.
+	h = NewHistory(f)
+	if n, err := h.Len(); err != nil || n != 50 {
+		t.Errorf("expected 50 frames, got %d (%v)", n, err)
+	}
+	keyframes := 0
+	for _, r := range h.index {
+		if r.keyframe {
+			keyframes++
+		}
+	}
+	if keyframes != 8 {
+		t.Errorf("expected 8 keyframes, got %d", keyframes)
+	}
+	testRandomSeeks(t, h, frames)
+}
+
+func TestLegacyFile(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	// Write two frames the way History did before the header was added.
+	var prev []byte
+	var frames [][]byte
+	s := rpg.NewState()
+	for i := 0; i < 2; i++ {
+		s.Atomic(func(s *rpg.State) bool {
+			s.Create(rpg.ResourcesFactory)
+			return true
+		})
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+			t.Fatal(err)
+		}
+		b, err := s.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		patch := bindiff.Diff(prev, buf.Bytes(), 10)
+		binary.Write(f, binary.LittleEndian, int64(len(patch)))
+		f.Write(patch)
+		binary.Write(f, binary.LittleEndian, int64(len(patch)))
+		prev = buf.Bytes()
+		frames = append(frames, b)
+	}
+
+	h := NewHistory(f)
+	frames = append(frames, testFrames(t, h, 20)...)
+	if !h.legacy {
+		t.Error("legacy file was not detected")
+	}
+	testRandomSeeks(t, NewHistory(f), frames)
+
+	f.Seek(0, SeekStart)
+	var header [len(magic)]byte
+	io.ReadFull(f, header[:])
+	if bytes.Equal(header[:], []byte(magic)) {
+		t.Error("header was added to a legacy file")
+	}
+}
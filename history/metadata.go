@@ -0,0 +1,153 @@
+package history
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/Rnoadm/rpg"
+	"io"
+	"strings"
+	"time"
+)
+
+// Metadata describes the action that led to a frame. Every field is optional.
+type Metadata struct {
+	Time  time.Time       // when the frame was appended
+	Actor rpg.ObjectIndex // the Object that acted, or zero
+	Label string          // the name of the action, such as "mine"
+	Args  []string        // the arguments of the action, such as coordinates
+}
+
+// String returns a description such as "3 mine 1 2 0", or "-" if m is nil.
+func (m *Metadata) String() string {
+	if m == nil {
+		return "-"
+	}
+	var parts []string
+	if m.Actor != 0 {
+		parts = append(parts, fmt.Sprint(m.Actor))
+	}
+	if m.Label != "" {
+		parts = append(parts, m.Label)
+	}
+	parts = append(parts, m.Args...)
+	return strings.Join(parts, " ")
+}
+
+// FrameInfo describes a frame without decoding its State.
+type FrameInfo struct {
+	Index    int64
+	Size     int64 // of the record in the file, in bytes
+	Keyframe bool
+	Metadata *Metadata // nil if the frame has none
+}
+
+const metadataVersion = 0
+
+var (
+	ErrMetadataVersion = errors.New("history: unrecognized metadata version")
+	ErrLegacy          = errors.New("history: file was written by an older version that does not support metadata")
+)
+
+func (m *Metadata) encode() ([]byte, error) {
+	t, err := m.Time.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := writeUvarint(nil, metadataVersion)
+	buf = writeBytes(buf, t)
+	buf = writeUvarint(buf, uint64(m.Actor))
+	buf = writeBytes(buf, []byte(m.Label))
+	buf = writeUvarint(buf, uint64(len(m.Args)))
+	for _, arg := range m.Args {
+		buf = writeBytes(buf, []byte(arg))
+	}
+	return buf, nil
+}
+
+func decodeMetadata(buf []byte) (*Metadata, error) {
+	version, buf, err := readUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	if version != metadataVersion {
+		return nil, ErrMetadataVersion
+	}
+
+	m := &Metadata{}
+	t, buf, err := readBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	if err = m.Time.UnmarshalBinary(t); err != nil {
+		return nil, err
+	}
+	actor, buf, err := readUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	m.Actor = rpg.ObjectIndex(actor)
+	label, buf, err := readBytes(buf)
+	if err != nil {
+		return nil, err
+	}
+	m.Label = string(label)
+	count, buf, err := readUvarint(buf)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(buf)) {
+		return nil, ErrCorrupt
+	}
+	for i := uint64(0); i < count; i++ {
+		var arg []byte
+		if arg, buf, err = readBytes(buf); err != nil {
+			return nil, err
+		}
+		m.Args = append(m.Args, string(arg))
+	}
+	if len(buf) != 0 {
+		return nil, ErrCorrupt
+	}
+	return m, nil
+}
+
+func readUvarint(buf []byte) (uint64, []byte, error) {
+	x, i := binary.Uvarint(buf)
+	if i <= 0 {
+		return x, buf, ErrCorrupt
+	}
+	return x, buf[i:], nil
+}
+
+func writeUvarint(buf []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], x)]...)
+}
+
+func readBytes(buf []byte) ([]byte, []byte, error) {
+	l, buf, err := readUvarint(buf)
+	if err != nil {
+		return nil, buf, err
+	}
+	if l > uint64(len(buf)) {
+		return nil, buf, ErrCorrupt
+	}
+	return buf[:l], buf[l:], nil
+}
+
+func writeBytes(buf, b []byte) []byte {
+	return append(writeUvarint(buf, uint64(len(b))), b...)
+}
+
+// byteReader reads one byte at a time from an io.Reader.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
@@ -0,0 +1,92 @@
+package history
+
+import (
+	"github.com/Rnoadm/rpg"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	h.KeyframeInterval = 2
+	start := time.Date(2014, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	var frames [][]byte
+	var metadata []*Metadata
+	s := rpg.NewState()
+	for i := 0; i < 6; i++ {
+		var m *Metadata
+		if i != 3 {
+			m = &Metadata{
+				Time:  start.Add(time.Duration(i) * time.Minute),
+				Actor: 1,
+				Label: "mine",
+				Args:  []string{"1", "2", "0"},
+			}
+		}
+		if err := h.AppendWithMetadata(s, m); err != nil {
+			t.Fatal(err)
+		}
+		b, err := s.GobEncode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, b)
+		metadata = append(metadata, m)
+	}
+
+	for _, h := range []*History{h, NewHistory(f)} {
+		info, err := h.Frames()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(info) != len(frames) {
+			t.Fatalf("expected %d frames, got %d", len(frames), len(info))
+		}
+		for i, fi := range info {
+			if fi.Index != int64(i) || fi.Keyframe != (i%2 == 0) || fi.Size <= 2*sizeof_int64 {
+				t.Errorf("frame %d: unexpected %+v", i, fi)
+			}
+			if !reflect.DeepEqual(fi.Metadata, metadata[i]) {
+				t.Errorf("frame %d: expected %v, got %v", i, metadata[i], fi.Metadata)
+			}
+		}
+
+		expect(t, frames[2], nil, 2)(h.SeekTime(start.Add(150 * time.Second)))(h.Tell())
+		expect(t, frames[2], nil, 2)(h.SeekTime(start.Add(3 * time.Minute)))(h.Tell())
+		expect(t, frames[5], nil, 5)(h.SeekTime(start.Add(time.Hour)))(h.Tell())
+		expect(t, nil, io.EOF, -1)(h.SeekTime(start.Add(-time.Second)))
+		if h.Tell() != 5 {
+			t.Errorf("SeekTime moved the cursor to %d", h.Tell())
+		}
+		testRandomSeeks(t, h, frames)
+	}
+
+	if s := metadata[0].String(); s != "1 mine 1 2 0" {
+		t.Errorf("unexpected string %q", s)
+	}
+	if s := metadata[3].String(); s != "-" {
+		t.Errorf("unexpected string %q", s)
+	}
+}
+
+func TestMetadataLegacy(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	h.legacy, h.base, h.indexed = true, 0, true
+	testFrames(t, h, 1)
+
+	if err := h.AppendWithMetadata(rpg.NewState(), &Metadata{Label: "x"}); err != ErrLegacy {
+		t.Errorf("expected ErrLegacy, got %v", err)
+	}
+	if n, err := h.Len(); err != nil || n != 1 {
+		t.Errorf("expected 1 frame, got %d (%v)", n, err)
+	}
+}
@@ -0,0 +1,197 @@
+package history
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestRecoverTornTail(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	h.KeyframeInterval = 4
+	frames := testFrames(t, h, 6)
+	good, err := f.Seek(0, SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testFrames(t, h, 1)
+	full, err := f.Seek(0, SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cut := range []int64{1, sizeof_int64, (full - good) / 2, full - good - sizeof_int64 - 1} {
+		if err = f.Truncate(full - cut); err != nil {
+			t.Fatal(err)
+		}
+
+		h = NewHistory(f)
+		if _, err = h.Len(); err == nil {
+			t.Errorf("cut %d: torn record was not detected", cut)
+		}
+		removed, err := h.Recover()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != full-cut-good {
+			t.Errorf("cut %d: expected %d bytes to be removed, got %d", cut, full-cut-good, removed)
+		}
+		testRandomSeeks(t, h, frames)
+
+		// Put the last frame back for the next cut.
+		testFrames(t, h, 1)
+	}
+}
+
+func TestRecoverChecksum(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	frames := testFrames(t, h, 4)
+	testFrames(t, h, 1)
+
+	// Flip a bit in the patch of the last record.
+	r := h.index[len(h.index)-1]
+	var b [1]byte
+	f.ReadAt(b[:], r.offset+sizeof_int64+r.size/2)
+	b[0] ^= 1
+	f.WriteAt(b[:], r.offset+sizeof_int64+r.size/2)
+
+	h = NewHistory(f)
+	if _, err := h.Seek(0, SeekEnd); err != ErrChecksum {
+		t.Errorf("expected ErrChecksum, got %v", err)
+	}
+	if removed, err := h.Recover(); err != nil || removed != r.end()-r.offset {
+		t.Errorf("expected %d bytes to be removed, got %d (%v)", r.end()-r.offset, removed, err)
+	}
+	testRandomSeeks(t, h, frames)
+}
+
+func TestRecoverMiddle(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	testFrames(t, h, 5)
+	size, err := f.Seek(0, SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the patch of a record that is followed by valid records.
+	r := h.index[2]
+	var b [1]byte
+	f.ReadAt(b[:], r.offset+sizeof_int64+r.size/2)
+	b[0] ^= 1
+	f.WriteAt(b[:], r.offset+sizeof_int64+r.size/2)
+
+	h = NewHistory(f)
+	removed, err := h.Recover()
+	if fe, ok := err.(*FrameError); !ok || fe.Frame != 2 || fe.Err != ErrChecksum {
+		t.Errorf("expected a checksum error for frame 2, got %v", err)
+	}
+	if removed != 0 {
+		t.Errorf("expected no bytes to be removed, got %d", removed)
+	}
+	if after, err := f.Seek(0, SeekEnd); err != nil || after != size {
+		t.Errorf("file was truncated from %d to %d bytes (%v)", size, after, err)
+	}
+}
+
+func TestRecoverHeader(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	f.Write([]byte(magic[:3]))
+	h := NewHistory(f)
+	if removed, err := h.Recover(); err != nil || removed != 3 {
+		t.Errorf("expected 3 bytes to be removed, got %d (%v)", removed, err)
+	}
+	testRandomSeeks(t, h, testFrames(t, h, 2))
+	if h.legacy {
+		t.Error("recovered file is legacy")
+	}
+}
+
+// testShortWriter writes at most n bytes of each Write.
+type testShortWriter struct {
+	*os.File
+	n int
+}
+
+var errTestShortWrite = errors.New("short write")
+
+func (w *testShortWriter) Write(b []byte) (int, error) {
+	if len(b) <= w.n {
+		return w.File.Write(b)
+	}
+	n, err := w.File.Write(b[:w.n])
+	if err == nil {
+		err = errTestShortWrite
+	}
+	return n, err
+}
+
+func TestAppendFailure(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	w := &testShortWriter{f, 1 << 30}
+	h := NewHistory(w)
+	frames := testFrames(t, h, 3)
+
+	w.n = 10
+	s, err := h.Seek(0, SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Append(s); err != errTestShortWrite {
+		t.Errorf("expected errTestShortWrite, got %v", err)
+	}
+	w.n = 1 << 30
+
+	testRandomSeeks(t, h, frames)
+	testRandomSeeks(t, NewHistory(f), frames)
+	if n, err := h.Len(); err != nil || n != 3 {
+		t.Errorf("expected 3 frames, got %d (%v)", n, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	f, cleanup := testFile(t)
+	defer cleanup()
+
+	h := NewHistory(f)
+	h.KeyframeInterval = 3
+	testFrames(t, h, 7)
+	if err := h.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a bit in the snapshot of the keyframe at frame 3 and fix its checksum, so only
+	// the comparison with the patches finds the problem.
+	r := h.index[3]
+	data := make([]byte, r.size)
+	f.ReadAt(data, r.offset+sizeof_int64)
+	data[len(data)-crc32.Size-1] ^= 1
+	binary.LittleEndian.PutUint32(data[len(data)-crc32.Size:], crc32.Checksum(data[:len(data)-crc32.Size], checksumTable))
+	f.WriteAt(data, r.offset+sizeof_int64)
+
+	err := NewHistory(f).Verify()
+	if fe, ok := err.(*FrameError); !ok || fe.Frame != 3 || fe.Err != ErrKeyframe {
+		t.Errorf("expected a keyframe error for frame 3, got %v", err)
+	}
+
+	f.Truncate(h.index[5].end() - 1)
+	err = NewHistory(f).Verify()
+	if fe, ok := err.(*FrameError); !ok || fe.Frame != 5 || fe.Err != io.ErrUnexpectedEOF {
+		t.Errorf("expected a torn record error for frame 5, got %v", err)
+	}
+}
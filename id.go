@@ -10,6 +10,13 @@ type sortedObjectIndices []ObjectIndex
 func (o sortedObjectIndices) Len() int           { return len(o) }
 func (o sortedObjectIndices) Less(i, j int) bool { return o[i] < o[j] }
 func (o sortedObjectIndices) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+func (o sortedObjectIndices) has(id ObjectIndex) bool {
+	i := sort.Search(len(o), func(i int) bool {
+		return o[i] >= id
+	})
+
+	return i < len(o) && o[i] == id
+}
 func (o *sortedObjectIndices) add(id ObjectIndex) bool {
 	i := sort.Search(len(*o), func(i int) bool {
 		return (*o)[i] >= id
@@ -35,6 +42,36 @@ func (o *sortedObjectIndices) remove(id ObjectIndex) bool {
 	}
 	return false
 }
+func (o sortedObjectIndices) intersect(b sortedObjectIndices) sortedObjectIndices {
+	n, j := 0, 0
+	for _, id := range o {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j == len(b) {
+			break
+		}
+		if b[j] == id {
+			o[n] = id
+			n++
+		}
+	}
+	return o[:n]
+}
+
+func (o sortedObjectIndices) difference(b sortedObjectIndices) sortedObjectIndices {
+	n, j := 0, 0
+	for _, id := range o {
+		for j < len(b) && b[j] < id {
+			j++
+		}
+		if j == len(b) || b[j] != id {
+			o[n] = id
+			n++
+		}
+	}
+	return o[:n]
+}
 func (o *sortedObjectIndices) Push(v interface{}) {
 	*o = append(*o, v.(ObjectIndex))
 }
@@ -0,0 +1,343 @@
+package rpg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync/atomic"
+)
+
+// The JSON representation of a State is an object with the following fields:
+//
+//	next_id     the ID that was last assigned to an Object (optional)
+//	migrations  the names of the StateMigrations that have been run (optional)
+//	objects     an array of objects, sorted by ID when encoded
+//
+// Each object has the following fields:
+//
+//	id          the ObjectIndex, which must be non-zero and unique
+//	parent      the ObjectIndex of the parent Object (optional)
+//	components  an object mapping registered Component names to their values
+//
+// The Components in this package are represented as follows:
+//
+//	rpg.Container  [1, 2, 3]
+//	rpg.Location   {"x": 0, "y": 0, "z": 0}
+//	rpg.Messages   [{"source": 1, "time": 0, "text": "hello", "kind": "chat"}]
+//	rpg.Name       "Bob"
+//	rpg.Random     {"seed": "1", "position": "0"}
+//	rpg.Resources  {"gold": 10}
+//
+// Other Components opt in to a readable form by implementing both json.Marshaler and
+// json.Unmarshaler. Any other Component is represented as {"gob": "..."}, where the
+// string is the base64 of its gob encoding.
+
+type jsonState struct {
+	NextID     uint64       `json:"next_id,omitempty"`
+	Migrations []string     `json:"migrations,omitempty"`
+	Objects    []jsonObject `json:"objects"`
+}
+
+type jsonObject struct {
+	ID         ObjectIndex                `json:"id"`
+	Parent     ObjectIndex                `json:"parent,omitempty"`
+	Components map[string]json.RawMessage `json:"components"`
+}
+
+type jsonGob struct {
+	Gob []byte `json:"gob"`
+}
+
+var (
+	ErrJSONObjectID        = errors.New("rpg: JSON object has no id")
+	ErrJSONObjectDuplicate = errors.New("rpg: JSON object id is used more than once")
+	ErrJSONOpaque          = errors.New("rpg: unregistered JSON component is not gob data")
+)
+
+// MarshalJSON implements json.Marshaler.
+func (s *State) MarshalJSON() ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.parent != nil {
+		return nil, ErrStateParent
+	}
+
+	s.clearDeleted()
+
+	js := jsonState{
+		NextID:     atomic.LoadUint64(s.nextObjectID),
+		Migrations: s.encodedMigrations(),
+		Objects:    make([]jsonObject, 0, len(s.objects)),
+	}
+
+	for _, o := range s.objects {
+		named, err := o.namedComponents()
+		if err != nil {
+			return nil, err
+		}
+		jo := jsonObject{
+			ID:         o.id,
+			Parent:     o.parent,
+			Components: make(map[string]json.RawMessage, len(named)),
+		}
+		for name, c := range named {
+			jo.Components[name], err = marshalComponentJSON(c)
+			if err != nil {
+				return nil, err
+			}
+		}
+		js.Objects = append(js.Objects, jo)
+	}
+	sort.Sort(sortedJSONObjects(js.Objects))
+
+	return json.Marshal(&js)
+}
+
+// UnmarshalJSON implements json.Unmarshaler. Components are resolved using the State's
+// Registry, and any StateMigration not listed in the JSON is run afterwards.
+func (s *State) UnmarshalJSON(data []byte) error {
+	if err := s.unmarshalJSON(data); err != nil {
+		return err
+	}
+	return s.migrate()
+}
+
+func (s *State) unmarshalJSON(data []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.parent != nil {
+		return ErrStateParent
+	}
+
+	var js jsonState
+	if err := json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+
+	registry := s.Registry()
+	objects := make(map[ObjectIndex]*Object, len(js.Objects))
+	nextID := js.NextID
+	for _, jo := range js.Objects {
+		if jo.ID == 0 {
+			return ErrJSONObjectID
+		}
+		if _, ok := objects[jo.ID]; ok {
+			return ErrJSONObjectDuplicate
+		}
+		if uint64(jo.ID) > nextID {
+			nextID = uint64(jo.ID)
+		}
+
+		o := &Object{
+			id:         jo.ID,
+			parent:     jo.Parent,
+			components: make(map[reflect.Type]Component, len(jo.Components)),
+			state:      s,
+		}
+		for name, raw := range jo.Components {
+			f, t, err := registry.lookup(name)
+			if registry.keeps(err) {
+				c, err := unmarshalOpaqueJSON(name, raw)
+				if err != nil {
+					return fmt.Errorf("rpg: object %d: %s: %v", jo.ID, name, err)
+				}
+				if o.opaque == nil {
+					o.opaque = make(map[string]*Opaque)
+				}
+				o.opaque[name] = c
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if _, ok := o.components[t]; ok {
+				return &DuplicateComponentError{Name: name}
+			}
+			c := f(o)
+			if err = registry.unmarshalComponentJSON(c, raw); err != nil {
+				return fmt.Errorf("rpg: object %d: %s: %v", jo.ID, name, err)
+			}
+			o.components[t] = c
+		}
+		objects[jo.ID] = o
+	}
+
+	if s.nextObjectID == nil {
+		s.deleted = make(map[ObjectIndex]uint64)
+		var a [3]uint64
+		s.nextObjectID, s.nextObjectVersion, s.componentsVersion = &a[0], &a[1], &a[2]
+		s.notifyCond.L = &s.notifyMtx
+	}
+	atomic.StoreUint64(s.nextObjectID, nextID)
+	s.migrations = js.Migrations
+	s.objects = objects
+	s.by_component = make(map[reflect.Type]sortedObjectIndices)
+	s.referrers = make(map[ObjectIndex]sortedObjectIndices)
+	s.spatial = make(map[chunk]sortedObjectIndices)
+	for id, o := range objects {
+		o.version = atomic.AddUint64(s.nextObjectVersion, 1)
+		s.reindex(id, nil, o)
+	}
+	atomic.AddUint64(s.componentsVersion, 1)
+
+	return nil
+}
+
+func marshalComponentJSON(c Component) (json.RawMessage, error) {
+	if _, ok := c.(json.Unmarshaler); ok {
+		if m, ok := c.(json.Marshaler); ok {
+			return m.MarshalJSON()
+		}
+	}
+	data, err := encodeComponent(c)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&jsonGob{Gob: data})
+}
+
+func (r *Registry) unmarshalComponentJSON(c Component, raw json.RawMessage) error {
+	if _, ok := c.(json.Marshaler); ok {
+		if u, ok := c.(json.Unmarshaler); ok {
+			return u.UnmarshalJSON(raw)
+		}
+	}
+	var g jsonGob
+	if err := json.Unmarshal(raw, &g); err != nil {
+		return err
+	}
+	return r.decodeComponentData(c, g.Gob)
+}
+
+// unmarshalOpaqueJSON keeps a Component that is not in the Registry. Only Components
+// that were encoded as gob data can be kept.
+func unmarshalOpaqueJSON(name string, raw json.RawMessage) (*Opaque, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil || len(fields) != 1 || fields["gob"] == nil {
+		return nil, ErrJSONOpaque
+	}
+	var g jsonGob
+	if err := json.Unmarshal(raw, &g); err != nil {
+		return nil, err
+	}
+	return &Opaque{name: name, data: g.Gob}, nil
+}
+
+type sortedJSONObjects []jsonObject
+
+func (o sortedJSONObjects) Len() int           { return len(o) }
+func (o sortedJSONObjects) Less(i, j int) bool { return o[i].ID < o[j].ID }
+func (o sortedJSONObjects) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+// MarshalJSON implements json.Marshaler.
+func (c *Container) MarshalJSON() ([]byte, error) {
+	if c.c == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]ObjectIndex(c.c))
+}
+
+// UnmarshalJSON implements json.Unmarshaler. The IDs do not need to be sorted.
+func (c *Container) UnmarshalJSON(data []byte) error {
+	var ids []ObjectIndex
+	if err := json.Unmarshal(data, &ids); err != nil {
+		return err
+	}
+	c.c = nil
+	for _, id := range ids {
+		c.c.add(id)
+	}
+	c.by_component = nil
+	return nil
+}
+
+type jsonLocation struct {
+	X int64 `json:"x"`
+	Y int64 `json:"y"`
+	Z int64 `json:"z"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (l *Location) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonLocation{l.x, l.y, l.z})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (l *Location) UnmarshalJSON(data []byte) error {
+	var jl jsonLocation
+	if err := json.Unmarshal(data, &jl); err != nil {
+		return err
+	}
+	l.x, l.y, l.z = jl.X, jl.Y, jl.Z
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r *Resources) MarshalJSON() ([]byte, error) {
+	if r.r == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(r.r)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *Resources) UnmarshalJSON(data []byte) error {
+	var m map[string]int64
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	if m == nil {
+		m = make(map[string]int64)
+	}
+	r.r = m
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (m *Messages) MarshalJSON() ([]byte, error) {
+	if m.m == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(m.m)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (m *Messages) UnmarshalJSON(data []byte) error {
+	m.m = nil
+	return json.Unmarshal(data, &m.m)
+}
+
+// jsonRandom uses strings because the values may not fit in a float64.
+type jsonRandom struct {
+	Seed     uint64 `json:"seed,string"`
+	Position uint64 `json:"position,string"`
+}
+
+// MarshalJSON implements json.Marshaler.
+func (r *Random) MarshalJSON() ([]byte, error) {
+	return json.Marshal(&jsonRandom{r.seed, r.position})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (r *Random) UnmarshalJSON(data []byte) error {
+	var jr jsonRandom
+	if err := json.Unmarshal(data, &jr); err != nil {
+		return err
+	}
+	r.seed, r.position = jr.Seed, jr.Position
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (n *Name) MarshalJSON() ([]byte, error) {
+	return json.Marshal(string(*n))
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (n *Name) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, (*string)(n))
+}
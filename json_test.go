@@ -0,0 +1,91 @@
+package rpg
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	r := NewRegistry()
+	ct, err := r.RegisterName("test.Registry", registryTestFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	global := NewStateWithRegistry(r)
+	var a, b ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		var o, p *Object
+		a, o = s.Create(ContainerFactory, LocationFactory, NameFactory("chest"), registryTestFactory)
+		b, p = o.Create(ResourcesFactory, MessagesFactory, LocationFactory)
+		o.Component(LocationType).(*Location).Set(1, 2, 3)
+		o.Component(ContainerType).(*Container).Add(p)
+		o.Component(ct).(*registryTestComponent).N = 42
+		p.Component(ResourcesType).(*Resources).Set("gold", 10)
+		p.Component(MessagesType).(*Messages).Append(Message{Source: a, Text: "hello"})
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	data, err := json.Marshal(global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`"rpg.Location":{"x":1,"y":2,"z":3}`,
+		`"rpg.Name":"chest"`,
+		`"rpg.Container":[2]`,
+		`"rpg.Resources":{"gold":10}`,
+		`"rpg.Messages":[{"source":1,"time":0,"text":"hello"}]`,
+		`"test.Registry":{"gob":"`,
+		`"parent":1`,
+	} {
+		if !bytes.Contains(data, []byte(expected)) {
+			t.Errorf("expected %s in %s", expected, data)
+		}
+	}
+
+	decoded := NewStateWithRegistry(r)
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if d, err := NewDelta(global, decoded); err != nil {
+		t.Error(err)
+	} else if ids := d.IDs(); len(ids) != 0 {
+		t.Errorf("objects changed by JSON round trip: %v", ids)
+	}
+	testContents(t, decoded, a, b)
+	testIDs(t, "At", decoded.At(1, 2, 3), a, b)
+	if n := decoded.Get(a).Component(ct).(*registryTestComponent).N; n != 42 {
+		t.Errorf("expected 42, got %d", n)
+	}
+}
+
+func TestJSONHandAuthored(t *testing.T) {
+	s := NewState()
+	if err := json.Unmarshal([]byte(`{"objects": [
+		{"id": 3, "components": {"rpg.Container": [5, 4]}},
+		{"id": 4, "components": {"rpg.Name": "pickaxe"}},
+		{"id": 5, "components": {"rpg.Resources": {"ore": 2}}}
+	]}`), s); err != nil {
+		t.Fatal(err)
+	}
+	testContents(t, s, 3, 4, 5)
+	testResources(t, s, 5, "ore", 2)
+	if id, _ := s.Create(); id != 6 {
+		t.Errorf("expected new object to be 6, got %d", id)
+	}
+
+	for _, bad := range []string{
+		`{"objects": [{"components": {}}]}`,
+		`{"objects": [{"id": 1}, {"id": 1}]}`,
+		`{"objects": [{"id": 1, "components": {"rpg.Unknown": {}}}]}`,
+		`{"objects": [{"id": 1, "components": {"rpg.Location": []}}]}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), NewState()); err == nil {
+			t.Errorf("decoding %s succeeded", bad)
+		}
+	}
+}
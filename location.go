@@ -12,7 +12,7 @@ func LocationFactory(o *Object) Component {
 }
 
 // LocationType can be used with Object.Component to retrieve a Location.
-var LocationType = RegisterComponent(LocationFactory)
+var LocationType = registerBuiltin("rpg.Location", LocationFactory)
 
 // Clone implements Component.
 func (l *Location) Clone(o *Object) Component {
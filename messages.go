@@ -3,10 +3,10 @@ package rpg
 var MaxMessages = 200
 
 type Message struct {
-	Source ObjectIndex
-	Time   int64
-	Text   string
-	Kind   string
+	Source ObjectIndex `json:"source,omitempty"`
+	Time   int64       `json:"time"`
+	Text   string      `json:"text"`
+	Kind   string      `json:"kind,omitempty"`
 }
 
 func (m *Message) String() string { return m.Text }
@@ -20,7 +20,7 @@ func MessagesFactory(o *Object) Component {
 	return &Messages{o: o}
 }
 
-var MessagesType = RegisterComponent(MessagesFactory)
+var MessagesType = registerBuiltin("rpg.Messages", MessagesFactory)
 
 func (m *Messages) Clone(o *Object) Component {
 	return &Messages{
@@ -0,0 +1,207 @@
+package rpg
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Migration converts the encoding of a Component from the version it was registered for
+// to a later version. The encoding is the data passed to GobDecode, which must start with
+// the version as a uvarint, as the Components in this package do.
+type Migration func(data []byte) ([]byte, error)
+
+// StateMigration modifies a State after it is decoded. It is run at most once for each
+// State, and it may call Atomic on the State.
+type StateMigration func(*State) error
+
+type stateMigration struct {
+	name string
+	f    StateMigration
+}
+
+var (
+	ErrMigrationVersion    = errors.New("rpg: Migration did not increase the version")
+	ErrMigrationNotDecoder = errors.New("rpg: Migration registered for a Component that does not implement gob.GobDecoder")
+)
+
+// MigrationError is returned when a Migration or StateMigration fails.
+type MigrationError struct {
+	Name    string
+	Version uint64 // zero for a StateMigration
+	Err     error
+}
+
+func (err *MigrationError) Error() string {
+	if err.Version == 0 {
+		return fmt.Sprintf("rpg: State migration %s failed: %v", err.Name, err.Err)
+	}
+	return fmt.Sprintf("rpg: migration of %s from version %d failed: %v", err.Name, err.Version, err.Err)
+}
+
+// RegisterMigration allows r to decode Components of type t that were encoded with the
+// given version. Migrations are applied one after another until the encoding has a
+// version with no Migration, and then it is passed to the Component's GobDecode method.
+func (r *Registry) RegisterMigration(t reflect.Type, from uint64, m Migration) error {
+	if !t.Implements(reflect.TypeOf((*gob.GobDecoder)(nil)).Elem()) {
+		return ErrMigrationNotDecoder
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	name, ok := r.names[t]
+	if !ok {
+		return &UnregisteredComponentError{Name: typeName(t)}
+	}
+	if _, ok := r.migrations[t][from]; ok {
+		return &DuplicateComponentError{Name: fmt.Sprintf("%s version %d migration", name, from)}
+	}
+	if r.migrations[t] == nil {
+		r.migrations[t] = make(map[uint64]Migration)
+	}
+	r.migrations[t][from] = m
+	return nil
+}
+
+// RegisterStateMigration adds a StateMigration to r. When a State that uses r is decoded,
+// each StateMigration that has not already been run on it is run in the order they were
+// registered. The name is recorded in the encoded State, so it must not change. States
+// created with NewState are assumed to not need any StateMigration.
+func (r *Registry) RegisterStateMigration(name string, f StateMigration) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for _, m := range r.stateMigrations {
+		if m.name == name {
+			return &DuplicateComponentError{Name: "State migration " + name}
+		}
+	}
+	r.stateMigrations = append(r.stateMigrations, stateMigration{name, f})
+	return nil
+}
+
+// migrate applies the Migrations for t to data.
+func (r *Registry) migrate(t reflect.Type, data []byte) ([]byte, error) {
+	r.mtx.RLock()
+	migrations := r.migrations[t]
+	name := r.names[t]
+	r.mtx.RUnlock()
+
+	for {
+		version, _, err := readUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		m, ok := migrations[version]
+		if !ok {
+			return data, nil
+		}
+		data, err = m(data)
+		if err != nil {
+			return nil, &MigrationError{Name: name, Version: version, Err: err}
+		}
+		if next, _, err := readUvarint(data); err != nil || next <= version {
+			return nil, &MigrationError{Name: name, Version: version, Err: ErrMigrationVersion}
+		}
+	}
+}
+
+// hasMigrations returns true if any Migration is registered for t.
+func (r *Registry) hasMigrations(t reflect.Type) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return len(r.migrations[t]) != 0
+}
+
+// stateMigrationNames returns the names of every StateMigration in r.
+func (r *Registry) stateMigrationNames() []string {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	names := make([]string, len(r.stateMigrations))
+	for i, m := range r.stateMigrations {
+		names[i] = m.name
+	}
+	return names
+}
+
+// encodedMigrations returns the names of the StateMigrations to record when s is encoded.
+// Every StateMigration in the Registry has either been run or was not needed. The caller
+// must hold s.mtx.
+func (s *State) encodedMigrations() []string {
+	migrations := append([]string(nil), s.migrations...)
+	for _, name := range s.Registry().stateMigrationNames() {
+		found := false
+		for _, m := range migrations {
+			if m == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			migrations = append(migrations, name)
+		}
+	}
+	return migrations
+}
+
+// rawGob captures the data sent by a gob.GobEncoder so it can be migrated before it is
+// passed to the Component.
+type rawGob []byte
+
+func (raw *rawGob) GobDecode(data []byte) error {
+	*raw = append((*raw)[:0], data...)
+	return nil
+}
+
+// decodeComponent decodes the next value from dec into c, applying any Migrations.
+func (r *Registry) decodeComponent(dec *gob.Decoder, c Component) error {
+	t := reflect.TypeOf(c)
+	if !r.hasMigrations(t) {
+		return dec.Decode(c)
+	}
+
+	var raw rawGob
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	data, err := r.migrate(t, raw)
+	if err != nil {
+		return err
+	}
+	return c.(gob.GobDecoder).GobDecode(data)
+}
+
+// migrate runs each StateMigration in s.Registry() that has not been run on s.
+func (s *State) migrate() error {
+	s.Registry().mtx.RLock()
+	migrations := s.Registry().stateMigrations
+	s.Registry().mtx.RUnlock()
+
+	for _, m := range migrations {
+		s.mtx.Lock()
+		done := false
+		for _, name := range s.migrations {
+			if name == m.name {
+				done = true
+				break
+			}
+		}
+		s.mtx.Unlock()
+		if done {
+			continue
+		}
+
+		if err := m.f(s); err != nil {
+			return &MigrationError{Name: m.name, Err: err}
+		}
+
+		s.mtx.Lock()
+		s.migrations = append(s.migrations, m.name)
+		s.mtx.Unlock()
+	}
+	return nil
+}
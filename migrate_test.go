@@ -0,0 +1,156 @@
+package rpg
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+)
+
+type migrationTestV0 struct {
+	a int64
+}
+
+func (c *migrationTestV0) Clone(*Object) Component {
+	clone := *c
+	return &clone
+}
+
+func (c *migrationTestV0) GobEncode() ([]byte, error) {
+	return writeVarint(writeUvarint(nil, 0), c.a), nil
+}
+
+func (c *migrationTestV0) GobDecode(data []byte) error {
+	return errors.New("not implemented")
+}
+
+type migrationTestV1 struct {
+	a, b int64
+}
+
+func (c *migrationTestV1) Clone(*Object) Component {
+	clone := *c
+	return &clone
+}
+
+func (c *migrationTestV1) GobEncode() ([]byte, error) {
+	return writeVarint(writeVarint(writeUvarint(nil, 1), c.a), c.b), nil
+}
+
+func (c *migrationTestV1) GobDecode(data []byte) (err error) {
+	version, data, err := readUvarint(data)
+	if err != nil {
+		return
+	}
+	if version != 1 {
+		return errors.New("unexpected version")
+	}
+	c.a, data, err = readVarint(data)
+	if err != nil {
+		return
+	}
+	c.b, data, err = readVarint(data)
+	return
+}
+
+func testRoundTrip(t *testing.T, s *State, r *Registry) *State {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		t.Fatal(err)
+	}
+	decoded := NewStateWithRegistry(r)
+	if err := gob.NewDecoder(&buf).Decode(decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestMigration(t *testing.T) {
+	r0 := NewRegistry()
+	if _, err := r0.RegisterName("test.Migrated", func(*Object) Component { return &migrationTestV0{a: 5} }); err != nil {
+		t.Fatal(err)
+	}
+	s := NewStateWithRegistry(r0)
+	id := testCreate(t, s, func(*Object) Component { return &migrationTestV0{a: 5} })
+
+	r1 := NewRegistry()
+	ct, err := r1.RegisterName("test.Migrated", func(*Object) Component { return &migrationTestV1{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r1.RegisterMigration(ct, 0, func(data []byte) ([]byte, error) {
+		a, _, err := readVarint(data[1:])
+		return writeVarint(writeVarint(writeUvarint(nil, 1), a), 7), err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = r1.RegisterMigration(ct, 0, nil); err == nil {
+		t.Error("duplicate RegisterMigration succeeded")
+	}
+
+	decoded := testRoundTrip(t, s, r1)
+	if c := decoded.Get(id).Component(ct).(*migrationTestV1); c.a != 5 || c.b != 7 {
+		t.Errorf("unexpected migrated component: %+v", c)
+	}
+
+	// A Migration must increase the version.
+	r2 := NewRegistry()
+	if _, err := r2.RegisterName("test.Migrated", func(*Object) Component { return &migrationTestV1{} }); err != nil {
+		t.Fatal(err)
+	}
+	r2.RegisterMigration(ct, 0, func(data []byte) ([]byte, error) { return data, nil })
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		t.Fatal(err)
+	}
+	err = gob.NewDecoder(&buf).Decode(NewStateWithRegistry(r2))
+	if merr, ok := err.(*MigrationError); !ok || merr.Err != ErrMigrationVersion {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStateMigration(t *testing.T) {
+	old := NewRegistry()
+	s := NewStateWithRegistry(old)
+	a := testCreate(t, s, ResourcesFactory)
+
+	runs := 0
+	r := NewRegistry()
+	if err := r.RegisterStateMigration("starting gold", func(s *State) error {
+		runs++
+		s.Atomic(func(s *State) bool {
+			for _, id := range s.ByComponent(ResourcesType) {
+				s.Get(id).Component(ResourcesType).(*Resources).Set("gold", 100)
+			}
+			return true
+		})
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.RegisterStateMigration("starting gold", nil); err == nil {
+		t.Error("duplicate RegisterStateMigration succeeded")
+	}
+
+	migrated := testRoundTrip(t, s, r)
+	testResources(t, migrated, a, "gold", 100)
+	if runs != 1 {
+		t.Errorf("expected 1 run, got %d", runs)
+	}
+
+	migrated.Atomic(func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 1)
+		return true
+	})
+	testResources(t, testRoundTrip(t, migrated, r), a, "gold", 1)
+	if runs != 1 {
+		t.Errorf("migration ran again on a migrated State")
+	}
+
+	fresh := NewStateWithRegistry(r)
+	b := testCreate(t, fresh, ResourcesFactory)
+	testResources(t, testRoundTrip(t, fresh, r), b, "gold", 0)
+	if runs != 1 {
+		t.Errorf("migration ran on a new State")
+	}
+}
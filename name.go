@@ -7,7 +7,7 @@ func NameFactory(name string) ComponentFactory {
 	return n.Clone
 }
 
-var NameType = RegisterComponent(NameFactory(""))
+var NameType = registerBuiltin("rpg.Name", NameFactory(""))
 
 func (n *Name) Clone(*Object) Component {
 	clone := *n
@@ -17,14 +17,14 @@ type Component interface {
 	Clone(*Object) Component
 }
 
-var registeredComponents = make(map[string]ComponentFactory)
-
 // RegisterComponent allows a ComponentFactory to be used with State.Create. It returns
-// the reflect.Type of the Component which can be used in Object.Component.
+// the reflect.Type of the Component which can be used in Object.Component. The factory is
+// added to DefaultRegistry, and RegisterComponent panics if its type is already there.
 func RegisterComponent(f ComponentFactory) reflect.Type {
-	c := f(nil)
-	t := reflect.TypeOf(c)
-	registeredComponents[typeName(t)] = f
+	t, err := DefaultRegistry.Register(f)
+	if err != nil {
+		panic(err)
+	}
 	return t
 }
 
@@ -45,9 +45,16 @@ func typeName(t reflect.Type) string {
 type Object struct {
 	id, parent ObjectIndex
 	components map[reflect.Type]Component
+	opaque     map[string]*Opaque
 	version    uint64
 	modified   bool
 	state      *State
+
+	// localVersion changes each time the Object is committed to a State that is not the
+	// root, where version does not, so that calls to Atomic nested in the same State
+	// detect each other's changes. localBase is the localVersion of the Object in the
+	// parent of its State when it was retrieved.
+	localVersion, localBase uint64
 }
 
 // ID returns the ID of this Object.
@@ -72,6 +79,41 @@ func (o *Object) ComponentAny(t reflect.Type) Component {
 	return nil
 }
 
+// AddComponent constructs a Component using f and adds it to o. The Component's type must
+// be pre-registered and o must not already have a Component of the same type.
+func (o *Object) AddComponent(f ComponentFactory) Component {
+	t, c := o.addComponent(f)
+	o.state.componentsChanged(o.id, t, c, true)
+	o.Modified()
+	return c
+}
+
+// RemoveComponent removes the Component of the given type from o, returning false if o
+// does not have a Component of that type.
+func (o *Object) RemoveComponent(t reflect.Type) bool {
+	c, ok := o.components[t]
+	if !ok {
+		return false
+	}
+	delete(o.components, t)
+	o.state.componentsChanged(o.id, t, c, false)
+	o.Modified()
+	return true
+}
+
+func (o *Object) addComponent(f ComponentFactory) (reflect.Type, Component) {
+	c := f(o)
+	t := reflect.TypeOf(c)
+	if !o.state.Registry().Registered(t) {
+		panic("rpg: unregistered component type " + t.String())
+	}
+	if _, ok := o.components[t]; ok {
+		panic("rpg: multiple components of type " + t.String())
+	}
+	o.components[t] = c
+	return t, c
+}
+
 // ID returns the parent of this Object if it has one.
 func (o *Object) Parent() *Object {
 	if o.parent == 0 {
@@ -83,18 +125,46 @@ func (o *Object) Parent() *Object {
 func (o *Object) clone(s *State) *Object {
 	clone := &Object{
 		id:         o.id,
+		parent:     o.parent,
 		components: make(map[reflect.Type]Component, len(o.components)),
 		version:    o.version,
 		modified:   false,
 		state:      s,
+
+		localVersion: o.localVersion,
+		localBase:    o.localVersion,
 	}
 	for t, c := range o.components {
 		clone.components[t] = c.Clone(clone)
 	}
+	if o.opaque != nil {
+		clone.opaque = make(map[string]*Opaque, len(o.opaque))
+		for name, c := range o.opaque {
+			clone.opaque[name] = c.Clone(clone).(*Opaque)
+		}
+	}
 
 	return clone
 }
 
+// namedComponents returns the Components of o, including any Opaque ones, by the name
+// they are encoded with.
+func (o *Object) namedComponents() (map[string]Component, error) {
+	registry := o.state.Registry()
+	named := make(map[string]Component, len(o.components)+len(o.opaque))
+	for t, c := range o.components {
+		name, err := registry.name(t)
+		if err != nil {
+			return nil, err
+		}
+		named[name] = c
+	}
+	for name, c := range o.opaque {
+		named[name] = c
+	}
+	return named, nil
+}
+
 // Modified notifies o that one of its Components has been modified. This is required
 // for State.Atomic to function properly.
 func (o *Object) Modified() {
@@ -103,7 +173,5 @@ func (o *Object) Modified() {
 
 // Create is the same as State.Create but the Object derives from o.
 func (o *Object) Create(factories ...ComponentFactory) (ObjectIndex, *Object) {
-	id, o2 := o.state.Create(factories...)
-	o2.parent = o.id
-	return id, o2
+	return o.state.create(o.id, factories)
 }
@@ -0,0 +1,181 @@
+package rpg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func equalIDs(a, b []ObjectIndex) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testByComponent(t *testing.T, s *State, ct reflect.Type, expected ...ObjectIndex) {
+	if ids := s.ByComponent(ct); !equalIDs(ids, expected) {
+		t.Errorf("ByComponent(%v): expected %v, got %v", ct, expected, ids)
+	}
+}
+
+func testContainerByComponent(t *testing.T, s *State, container ObjectIndex, ct reflect.Type, expected ...ObjectIndex) {
+	var ids []ObjectIndex
+	for _, o := range s.Get(container).Component(ContainerType).(*Container).ByComponent(ct) {
+		ids = append(ids, o.ID())
+	}
+	if !equalIDs(ids, expected) {
+		t.Errorf("Container.ByComponent(%v): expected %v, got %v", ct, expected, ids)
+	}
+}
+
+func TestAddRemoveComponent(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, NameFactory("a"))
+	b := testCreate(t, global, NameFactory("b"), ResourcesFactory)
+
+	if !global.Atomic(func(s *State) bool {
+		r := s.Get(a).AddComponent(ResourcesFactory).(*Resources)
+		r.Set("gold", 1)
+		if !s.Get(b).RemoveComponent(ResourcesType) {
+			t.Error("RemoveComponent returned false")
+		}
+		if s.Get(b).RemoveComponent(ResourcesType) {
+			t.Error("RemoveComponent returned true for a missing Component")
+		}
+
+		testByComponent(t, s, ResourcesType, a)
+		testByComponent(t, global, ResourcesType, b)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	testByComponent(t, global, ResourcesType, a)
+	testByComponent(t, global, NameType, a, b)
+	testResources(t, global, a, "gold", 1)
+	if global.Get(b).Component(ResourcesType) != nil {
+		t.Error("removed Component still exists")
+	}
+}
+
+func TestAddRemoveComponentRollback(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, NameFactory("a"))
+	b := testCreate(t, global, NameFactory("b"), ResourcesFactory)
+
+	if global.Atomic(func(s *State) bool {
+		s.Get(a).AddComponent(ResourcesFactory)
+		s.Get(b).RemoveComponent(ResourcesType)
+		return false
+	}) {
+		t.Fatal("Atomic succeeded")
+	}
+
+	testByComponent(t, global, ResourcesType, b)
+	if global.Get(a).Component(ResourcesType) != nil {
+		t.Error("added Component was not rolled back")
+	}
+	if global.Get(b).Component(ResourcesType) == nil {
+		t.Error("removed Component was not rolled back")
+	}
+}
+
+func TestAddRemoveComponentContainer(t *testing.T) {
+	global := NewState()
+
+	var bag, a, b ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		var o, oa, ob *Object
+		bag, o = s.Create(ContainerFactory)
+		a, oa = s.Create(NameFactory("a"))
+		b, ob = s.Create(NameFactory("b"), LocationFactory)
+		o.Component(ContainerType).(*Container).Add(oa)
+		o.Component(ContainerType).(*Container).Add(ob)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	testContainerByComponent(t, global, bag, LocationType, b)
+
+	if global.Atomic(func(s *State) bool {
+		s.Get(a).AddComponent(LocationFactory)
+		s.Get(b).RemoveComponent(LocationType)
+		testContainerByComponent(t, s, bag, LocationType, a)
+		return false
+	}) {
+		t.Fatal("Atomic succeeded")
+	}
+	testContainerByComponent(t, global, bag, LocationType, b)
+
+	if !global.Atomic(func(s *State) bool {
+		s.Get(a).AddComponent(LocationFactory)
+		s.Get(b).RemoveComponent(LocationType)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	testContainerByComponent(t, global, bag, LocationType, a)
+	testContainerByComponent(t, global, bag, NameType, a, b)
+}
+
+func TestAddComponentContainerIndexedBeforeCommit(t *testing.T) {
+	global := NewState()
+
+	var bag, a ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		var o, oa *Object
+		bag, o = s.Create(ContainerFactory)
+		a, oa = s.Create(NameFactory("a"))
+		o.Component(ContainerType).(*Container).Add(oa)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	if !global.Atomic(func(s *State) bool {
+		s.Get(a).AddComponent(LocationFactory)
+		// Index the root's Container after the Component was added but before it
+		// is committed.
+		testContainerByComponent(t, global, bag, LocationType)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	testContainerByComponent(t, global, bag, LocationType, a)
+
+	if !global.Atomic(func(s *State) bool {
+		return s.Atomic(func(s2 *State) bool {
+			s2.Get(a).RemoveComponent(LocationType)
+			testContainerByComponent(t, s, bag, LocationType, a)
+			return true
+		})
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	testContainerByComponent(t, global, bag, LocationType)
+}
+
+func TestAddComponentConflict(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, NameFactory("a"))
+
+	attempts := testNestedConflict(t, global, func(s *State) bool {
+		s.Get(a).AddComponent(ResourcesFactory).(*Resources).Set("gold", 1)
+		return true
+	}, func(s *State) bool {
+		s.Get(a).AddComponent(LocationFactory)
+		return true
+	})
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	testByComponent(t, global, ResourcesType, a)
+	testByComponent(t, global, LocationType, a)
+	testResources(t, global, a, "gold", 1)
+}
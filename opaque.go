@@ -0,0 +1,26 @@
+package rpg
+
+// Opaque is a Component that was decoded by a Registry that keeps unregistered Components.
+// It holds the gob encoding of the Component so that the Object can be encoded again, or
+// compared with Diff, without knowing the Component's type. Opaque Components are not
+// returned by Object.Component and are not indexed by State.ByComponent.
+type Opaque struct {
+	name string
+	data []byte
+}
+
+// Clone implements Component.
+func (c *Opaque) Clone(*Object) Component {
+	return &Opaque{name: c.name, data: c.data}
+}
+
+// Name returns the name the Component was encoded with.
+func (c *Opaque) Name() string {
+	return c.name
+}
+
+// Data returns the data the Component's GobEncode method returned. It must not be
+// modified.
+func (c *Opaque) Data() []byte {
+	return c.data
+}
@@ -0,0 +1,132 @@
+package rpg
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Query finds Objects in a State by their Components. A Query is not modified by its
+// methods, so a partial Query can be reused.
+type Query struct {
+	s       *State
+	with    []reflect.Type
+	without []reflect.Type
+	where   []func(*Object) bool
+}
+
+// Query returns a Query that matches every Object in s.
+func (s *State) Query() *Query {
+	return &Query{s: s}
+}
+
+// With returns a Query that only matches Objects that also have every given Component
+// type.
+func (q *Query) With(types ...reflect.Type) *Query {
+	clone := *q
+	clone.with = append(append([]reflect.Type(nil), q.with...), types...)
+	return &clone
+}
+
+// Without returns a Query that only matches Objects that also have none of the given
+// Component types.
+func (q *Query) Without(types ...reflect.Type) *Query {
+	clone := *q
+	clone.without = append(append([]reflect.Type(nil), q.without...), types...)
+	return &clone
+}
+
+// Where returns a Query that only matches Objects for which f also returns true. f is
+// called after the Component types are checked.
+func (q *Query) Where(f func(*Object) bool) *Query {
+	clone := *q
+	clone.where = append(append([]func(*Object) bool(nil), q.where...), f)
+	return &clone
+}
+
+// IDs returns the sorted set of IDs of Objects that match q.
+func (q *Query) IDs() []ObjectIndex {
+	ids := q.candidates()
+	if len(q.where) == 0 {
+		return []ObjectIndex(ids)
+	}
+
+	n := 0
+	for _, id := range ids {
+		if o := q.s.Get(id); o != nil && q.match(o) {
+			ids[n] = id
+			n++
+		}
+	}
+	return []ObjectIndex(ids[:n])
+}
+
+// Objects returns the Objects that match q, sorted by ID.
+func (q *Query) Objects() []*Object {
+	var objects []*Object
+	q.Each(func(o *Object) bool {
+		objects = append(objects, o)
+		return true
+	})
+	return objects
+}
+
+// Each calls f for each Object that matches q in order of ID until f returns false.
+func (q *Query) Each(f func(*Object) bool) {
+	for _, id := range q.candidates() {
+		if o := q.s.Get(id); o != nil && q.match(o) && !f(o) {
+			return
+		}
+	}
+}
+
+// First returns the matching Object with the lowest ID, or nil if no Objects match q.
+func (q *Query) First() *Object {
+	var first *Object
+	q.Each(func(o *Object) bool {
+		first = o
+		return false
+	})
+	return first
+}
+
+func (q *Query) match(o *Object) bool {
+	for _, f := range q.where {
+		if !f(o) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the IDs of Objects that satisfy the Component types of q.
+func (q *Query) candidates() sortedObjectIndices {
+	var ids sortedObjectIndices
+	if len(q.with) == 0 {
+		ids = sortedObjectIndices(q.s.IDs())
+	} else {
+		lists := make([]sortedObjectIndices, len(q.with))
+		for i, t := range q.with {
+			lists[i] = q.s.byComponent(t)
+		}
+		// Intersecting the shortest lists first keeps the intermediate
+		// results small.
+		sort.Sort(sortedByLength(lists))
+		ids = lists[0]
+		for _, b := range lists[1:] {
+			ids = ids.intersect(b)
+		}
+	}
+	for _, t := range q.without {
+		if len(ids) == 0 {
+			break
+		}
+		ids = ids.difference(q.s.byComponent(t))
+	}
+	return ids
+}
+
+type sortedByLength []sortedObjectIndices
+
+func (l sortedByLength) Len() int           { return len(l) }
+func (l sortedByLength) Less(i, j int) bool { return len(l[i]) < len(l[j]) }
+func (l sortedByLength) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
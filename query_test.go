@@ -0,0 +1,86 @@
+package rpg
+
+import "testing"
+
+func testQuery(t *testing.T, q *Query, expected ...ObjectIndex) {
+	if ids := q.IDs(); !equalIDs(ids, expected) {
+		t.Errorf("IDs: expected %v, got %v", expected, ids)
+	}
+	var ids []ObjectIndex
+	for _, o := range q.Objects() {
+		ids = append(ids, o.ID())
+	}
+	if !equalIDs(ids, expected) {
+		t.Errorf("Objects: expected %v, got %v", expected, ids)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, LocationFactory, ContainerFactory)
+	b := testCreate(t, global, LocationFactory, ContainerFactory, ResourcesFactory)
+	c := testCreate(t, global, LocationFactory)
+	d := testCreate(t, global, ContainerFactory)
+
+	testQuery(t, global.Query(), a, b, c, d)
+	testQuery(t, global.Query().With(LocationType), a, b, c)
+	testQuery(t, global.Query().With(LocationType, ContainerType), a, b)
+	testQuery(t, global.Query().With(LocationType).With(ContainerType).Without(ResourcesType), a)
+	testQuery(t, global.Query().Without(LocationType), d)
+	testQuery(t, global.Query().With(NameType))
+
+	far := global.Query().With(LocationType).Where(func(o *Object) bool {
+		x, _, _ := o.Component(LocationType).(*Location).Get()
+		return x > 0
+	})
+	testQuery(t, far)
+
+	if !global.Atomic(func(s *State) bool {
+		s.Get(b).Component(LocationType).(*Location).Set(1, 0, 0)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	testQuery(t, far, b)
+
+	if o := global.Query().With(ContainerType).First(); o == nil || o.ID() != a {
+		t.Errorf("First: expected %d, got %v", a, o)
+	}
+	if o := global.Query().With(NameType).First(); o != nil {
+		t.Errorf("First: expected nil, got %d", o.ID())
+	}
+}
+
+func TestQueryAtomic(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, LocationFactory, ContainerFactory)
+	b := testCreate(t, global, LocationFactory, ContainerFactory)
+	c := testCreate(t, global, LocationFactory)
+
+	var e ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		q := s.Query().With(LocationType, ContainerType)
+
+		s.Delete(a)
+		s.Get(c).AddComponent(ContainerFactory)
+		e, _ = s.Create(LocationFactory, ContainerFactory)
+		testQuery(t, q, b, c, e)
+
+		if s.Atomic(func(s *State) bool {
+			s.Get(b).RemoveComponent(ContainerType)
+			s.Delete(e)
+			testQuery(t, s.Query().With(LocationType, ContainerType), c)
+			return false
+		}) {
+			t.Error("inner Atomic succeeded")
+		}
+		testQuery(t, q, b, c, e)
+
+		testQuery(t, global.Query().With(LocationType, ContainerType), a, b)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	testQuery(t, global.Query().With(LocationType, ContainerType), b, c, e)
+}
@@ -0,0 +1,89 @@
+package rpg
+
+// Random is a Component that generates pseudo-random numbers. The numbers are determined
+// by the seed and the number of values already generated, both of which are part of the
+// State, so a function passed to Atomic that is retried generates the same numbers it did
+// the first time if nothing else used the Random in between, and a State loaded from a
+// history.History generates the same numbers it did when it was saved. Generating a value
+// modifies the Object, so concurrent calls to Atomic that use the same Random conflict.
+//
+// Random implements math/rand.Source64, so rand.New can be used to get the other
+// functions in math/rand. The numbers are not suitable for cryptography.
+type Random struct {
+	seed     uint64
+	position uint64
+	o        *Object
+}
+
+// RandomFactory returns a ComponentFactory for a Random with the given seed.
+func RandomFactory(seed int64) ComponentFactory {
+	return func(o *Object) Component {
+		return &Random{seed: uint64(seed), o: o}
+	}
+}
+
+// RandomType can be used with Object.Component to retrieve a Random.
+var RandomType = registerBuiltin("rpg.Random", RandomFactory(0))
+
+// Clone implements Component.
+func (r *Random) Clone(o *Object) Component {
+	return &Random{
+		seed:     r.seed,
+		position: r.position,
+		o:        o,
+	}
+}
+
+// Seed implements math/rand.Source. It restarts the sequence of numbers.
+func (r *Random) Seed(seed int64) {
+	r.seed, r.position = uint64(seed), 0
+	r.o.Modified()
+}
+
+// Position returns the number of values generated since r was seeded.
+func (r *Random) Position() uint64 {
+	return r.position
+}
+
+// Uint64 implements math/rand.Source64.
+func (r *Random) Uint64() uint64 {
+	// SplitMix64, which can compute any position in the sequence directly.
+	r.position++
+	z := r.seed + r.position*0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	r.o.Modified()
+	return z ^ (z >> 31)
+}
+
+// Int63 implements math/rand.Source.
+func (r *Random) Int63() int64 {
+	return int64(r.Uint64() >> 1)
+}
+
+// Int63n returns a number in [0, n). It panics if n <= 0.
+func (r *Random) Int63n(n int64) int64 {
+	if n <= 0 {
+		panic("rpg: invalid argument to Int63n")
+	}
+	// Reject the values that would make some results more likely than others.
+	max := int64((1 << 63) - 1 - (1<<63)%uint64(n))
+	v := r.Int63()
+	for v > max {
+		v = r.Int63()
+	}
+	return v % n
+}
+
+// Intn returns a number in [0, n). It panics if n <= 0.
+func (r *Random) Intn(n int) int {
+	if n <= 0 {
+		panic("rpg: invalid argument to Intn")
+	}
+	return int(r.Int63n(int64(n)))
+}
+
+// Float64 returns a number in [0.0, 1.0).
+func (r *Random) Float64() float64 {
+	return float64(r.Uint64()>>11) / (1 << 53)
+}
@@ -0,0 +1,118 @@
+package rpg
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+)
+
+var _ rand.Source64 = (*Random)(nil)
+
+func testRandomValues(s *State, id ObjectIndex, count int) []int64 {
+	var values []int64
+	s.Atomic(func(s *State) bool {
+		values = values[:0]
+		r := s.Get(id).Component(RandomType).(*Random)
+		for i := 0; i < count; i++ {
+			values = append(values, r.Int63n(1000))
+		}
+		return true
+	})
+	return values
+}
+
+func equalValues(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRandomReproducible(t *testing.T) {
+	global := NewState()
+	id := testCreate(t, global, RandomFactory(42))
+	saved := testEncodeState(t, global)
+
+	first := testRandomValues(global, id, 10)
+	second := testRandomValues(global, id, 10)
+	if equalValues(first, second) {
+		t.Error("the sequence did not advance")
+	}
+	for _, v := range append(first, second...) {
+		if v < 0 || v >= 1000 {
+			t.Errorf("value %d is out of range", v)
+		}
+	}
+
+	// A saved State continues from where it was saved.
+	loaded := testDecodeState(t, saved)
+	if values := testRandomValues(loaded, id, 20); !equalValues(values, append(first, second...)) {
+		t.Errorf("expected %v, got %v", append(first, second...), values)
+	}
+
+	// A different seed gives different values.
+	other := NewState()
+	otherID := testCreate(t, other, RandomFactory(43))
+	if equalValues(testRandomValues(other, otherID, 10), first) {
+		t.Error("different seeds gave the same values")
+	}
+
+	var position uint64
+	global.Atomic(func(s *State) bool {
+		position = s.Get(id).Component(RandomType).(*Random).Position()
+		return false
+	})
+	if position != 20 {
+		t.Errorf("expected position 20, got %d", position)
+	}
+}
+
+func TestRandomAtomicRetry(t *testing.T) {
+	global := NewState()
+	id := testCreate(t, global, RandomFactory(7), ResourcesFactory)
+
+	// The first attempt conflicts with a concurrent change to another Component of the
+	// same Object, so f is run again from the same position.
+	var attempts []int64
+	global.Atomic(func(s *State) bool {
+		v := s.Get(id).Component(RandomType).(*Random).Int63()
+		attempts = append(attempts, v)
+		s.Get(id).Component(ResourcesType).(*Resources).Set("roll", v)
+		if len(attempts) == 1 {
+			global.Atomic(func(s *State) bool {
+				s.Get(id).Component(ResourcesType).(*Resources).Set("other", 1)
+				return true
+			})
+		}
+		return true
+	})
+	if len(attempts) != 2 {
+		t.Fatalf("expected 2 attempts, got %d", len(attempts))
+	}
+	if attempts[0] != attempts[1] {
+		t.Errorf("the retry gave %d instead of %d", attempts[1], attempts[0])
+	}
+}
+
+func TestRandomJSON(t *testing.T) {
+	global := NewState()
+	id := testCreate(t, global, RandomFactory(-1))
+	testRandomValues(global, id, 3)
+
+	data, err := json.Marshal(global)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewState()
+	if err = json.Unmarshal(data, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := testRandomValues(global, id, 5), testRandomValues(loaded, id, 5); !equalValues(a, b) {
+		t.Errorf("expected %v, got %v", a, b)
+	}
+}
@@ -0,0 +1,128 @@
+package rpg
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Referrer is implemented by Components that refer to other Objects in the same State.
+// The references are tracked by the State so that deleting an Object can find them.
+type Referrer interface {
+	Component
+
+	// References returns the ObjectIndex of each Object this Component refers to.
+	References() []ObjectIndex
+
+	// RemoveReference removes every reference to id from this Component. It is called
+	// when the Object identified by id is deleted.
+	RemoveReference(id ObjectIndex)
+}
+
+// DeletePolicy determines what State.DeleteWith does with references to the deleted
+// Object.
+type DeletePolicy int
+
+const (
+	// DeleteRestrict refuses to delete an Object that is the parent of another Object
+	// or is referred to by a Referrer.
+	DeleteRestrict DeletePolicy = iota
+	// DeleteCascade removes the Object from every Referrer and deletes its children
+	// using DeleteCascade.
+	DeleteCascade
+	// DeleteNullify removes the Object from every Referrer and gives its children the
+	// deleted Object's parent.
+	DeleteNullify
+)
+
+// ReferencedError is returned by State.DeleteWith when DeleteRestrict prevents an Object
+// from being deleted.
+type ReferencedError struct {
+	ID        ObjectIndex
+	Referrers []ObjectIndex
+}
+
+func (err *ReferencedError) Error() string {
+	return fmt.Sprintf("rpg: object %d is referenced by %v", err.ID, err.Referrers)
+}
+
+// DeleteWith removes an object from the State. Future calls to Get will return nil.
+// Objects that refer to it are handled according to policy.
+func (s *State) DeleteWith(id ObjectIndex, policy DeletePolicy) error {
+	o := s.Get(id)
+	if o == nil {
+		return nil
+	}
+
+	referrers := s.Referrers(id)
+	if policy == DeleteRestrict {
+		for _, ref := range referrers {
+			if ref != id {
+				return &ReferencedError{ID: id, Referrers: referrers}
+			}
+		}
+	}
+
+	for _, ref := range referrers {
+		r := s.Get(ref)
+		if r == nil {
+			continue
+		}
+		if r.parent == id && ref != id {
+			if policy == DeleteCascade {
+				if err := s.DeleteWith(ref, DeleteCascade); err != nil {
+					return err
+				}
+				continue
+			}
+			r.parent = o.parent
+			r.Modified()
+		}
+		for _, c := range r.components {
+			if c, ok := c.(Referrer); ok {
+				c.RemoveReference(id)
+			}
+		}
+	}
+
+	s.delete(id, o)
+	return nil
+}
+
+// Referrers returns the sorted set of IDs of Objects that are children of the Object
+// identified by id or that have a Referrer Component that refers to it.
+func (s *State) Referrers(id ObjectIndex) []ObjectIndex {
+	return []ObjectIndex(s.referrersOf(id))
+}
+
+func (s *State) referrersOf(id ObjectIndex) sortedObjectIndices {
+	return s.overlay(func(root *State) sortedObjectIndices {
+		return append(sortedObjectIndices(nil), root.referrers[id]...)
+	}, func(o *Object) bool {
+		return o.references().has(id)
+	})
+}
+
+// references returns the sorted set of Objects that o refers to, including its parent.
+func (o *Object) references() sortedObjectIndices {
+	var refs sortedObjectIndices
+	if o.parent != 0 {
+		refs = append(refs, o.parent)
+	}
+	for _, c := range o.components {
+		if c, ok := c.(Referrer); ok {
+			refs = append(refs, c.References()...)
+		}
+	}
+	if len(refs) < 2 {
+		return refs
+	}
+	sort.Sort(refs)
+	n := 1
+	for _, ref := range refs[1:] {
+		if ref != refs[n-1] {
+			refs[n] = ref
+			n++
+		}
+	}
+	return refs[:n]
+}
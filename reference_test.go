@@ -0,0 +1,155 @@
+package rpg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testContents(t *testing.T, s *State, container ObjectIndex, expected ...ObjectIndex) {
+	var ids []ObjectIndex
+	for _, o := range s.Get(container).Component(ContainerType).(*Container).Contents() {
+		ids = append(ids, o.ID())
+	}
+	if !equalIDs(ids, expected) {
+		t.Errorf("Contents: expected %v, got %v", expected, ids)
+	}
+}
+
+// testReferences creates a bag that contains an item, and the item has a child which has
+// a child.
+func testReferences(t *testing.T) (global *State, bag, item, child, grandchild ObjectIndex) {
+	global = NewState()
+	if !global.Atomic(func(s *State) bool {
+		var b, i, c *Object
+		bag, b = s.Create(ContainerFactory)
+		item, i = s.Create(ResourcesFactory)
+		child, c = i.Create(ResourcesFactory)
+		grandchild, _ = c.Create(ResourcesFactory)
+		b.Component(ContainerType).(*Container).Add(i)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	return
+}
+
+func TestDeleteRestrict(t *testing.T) {
+	global, bag, item, child, _ := testReferences(t)
+
+	if !global.Atomic(func(s *State) bool {
+		err := s.DeleteWith(item, DeleteRestrict)
+		expected := &ReferencedError{ID: item, Referrers: []ObjectIndex{bag, child}}
+		if !reflect.DeepEqual(err, expected) {
+			t.Errorf("expected %v, got %v", expected, err)
+		}
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	if global.Get(item) == nil {
+		t.Error("referenced object was deleted")
+	}
+	testContents(t, global, bag, item)
+}
+
+func TestDeleteNullify(t *testing.T) {
+	global, bag, item, child, grandchild := testReferences(t)
+
+	if !global.Atomic(func(s *State) bool {
+		if err := s.DeleteWith(item, DeleteNullify); err != nil {
+			t.Error(err)
+		}
+		testContents(t, s, bag)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	if global.Get(item) != nil {
+		t.Error("object was not deleted")
+	}
+	testContents(t, global, bag)
+	if p := global.Get(child).Parent(); p != nil {
+		t.Errorf("child has parent %d", p.ID())
+	}
+	if p := global.Get(grandchild).Parent(); p == nil || p.ID() != child {
+		t.Error("grandchild lost its parent")
+	}
+	if ids := global.Referrers(item); len(ids) != 0 {
+		t.Errorf("deleted object is still referenced by %v", ids)
+	}
+	testByComponent(t, global, ResourcesType, child, grandchild)
+}
+
+func TestDeleteCascade(t *testing.T) {
+	global, bag, item, child, grandchild := testReferences(t)
+
+	if !global.Atomic(func(s *State) bool {
+		if err := s.DeleteWith(item, DeleteCascade); err != nil {
+			t.Error(err)
+		}
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	for _, id := range []ObjectIndex{item, child, grandchild} {
+		if global.Get(id) != nil {
+			t.Errorf("object %d was not deleted", id)
+		}
+	}
+	testContents(t, global, bag)
+	testByComponent(t, global, ResourcesType)
+	testByComponent(t, global, ContainerType, bag)
+}
+
+func TestDeleteReferencedConcurrently(t *testing.T) {
+	global := NewState()
+	bag := testCreate(t, global, ContainerFactory)
+	item := testCreate(t, global, ResourcesFactory)
+
+	attempts := 0
+	if !global.Atomic(func(s *State) bool {
+		attempts++
+		s.Delete(item)
+		if attempts == 1 && !global.Atomic(func(s *State) bool {
+			return s.Get(bag).Component(ContainerType).(*Container).Add(s.Get(item))
+		}) {
+			t.Error("concurrent Atomic failed")
+		}
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	if global.Get(item) != nil {
+		t.Error("object was not deleted")
+	}
+	if refs := global.Get(bag).Component(ContainerType).(*Container).References(); len(refs) != 0 {
+		t.Errorf("dangling references: %v", refs)
+	}
+}
+
+func TestContainerContentsMissing(t *testing.T) {
+	global := NewState()
+
+	var bag, item ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		var b, i *Object
+		bag, b = s.Create(ContainerFactory)
+		item, i = s.Create(NameFactory("item"))
+		c := b.Component(ContainerType).(*Container)
+		c.Add(i)
+		c.c.add(item + 1)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	testContents(t, global, bag, item)
+	testContainerByComponent(t, global, bag, NameType, item)
+}
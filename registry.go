@@ -0,0 +1,218 @@
+package rpg
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Registry is a set of ComponentFactory that can be used with a State. It is safe to use
+// a Registry from multiple goroutines.
+//
+// Each Component type is registered under a name that is used when encoding a State. A
+// type may also have aliases, which are accepted when decoding. The Go type name of the
+// Component, which includes its import path, is always an alias so that States encoded
+// before a name was chosen can still be decoded.
+type Registry struct {
+	mtx       sync.RWMutex
+	factories map[string]ComponentFactory
+	types     map[string]reflect.Type
+	names     map[reflect.Type]string
+	aliases   map[string]string
+
+	migrations      map[reflect.Type]map[uint64]Migration
+	stateMigrations []stateMigration
+
+	keepUnregistered bool
+}
+
+// DefaultRegistry is used by States that were not created with NewStateWithRegistry. It
+// contains every Component registered with RegisterComponent or RegisterComponentName.
+var DefaultRegistry = newRegistry()
+
+type builtinComponent struct {
+	name string
+	f    ComponentFactory
+}
+
+// builtinComponents are the Components defined by this package, which are included in
+// every Registry.
+var builtinComponents []builtinComponent
+
+func registerBuiltin(name string, f ComponentFactory) reflect.Type {
+	builtinComponents = append(builtinComponents, builtinComponent{name, f})
+	return RegisterComponentName(name, f)
+}
+
+func newRegistry() *Registry {
+	return &Registry{
+		factories: make(map[string]ComponentFactory),
+		types:     make(map[string]reflect.Type),
+		names:     make(map[reflect.Type]string),
+		aliases:   make(map[string]string),
+
+		migrations: make(map[reflect.Type]map[uint64]Migration),
+	}
+}
+
+// NewRegistry returns a Registry containing only the Components defined by this package.
+func NewRegistry() *Registry {
+	r := newRegistry()
+	for _, b := range builtinComponents {
+		if _, err := r.RegisterName(b.name, b.f); err != nil {
+			panic(err)
+		}
+	}
+	return r
+}
+
+// RegisterComponentName is the same as RegisterComponent, but the Component is encoded
+// using the given name and may be decoded using the name or any of the aliases.
+func RegisterComponentName(name string, f ComponentFactory, aliases ...string) reflect.Type {
+	t, err := DefaultRegistry.RegisterName(name, f, aliases...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// DuplicateComponentError is returned when a Component type is registered twice or an
+// encoded Object has more than one Component of the same type.
+type DuplicateComponentError struct {
+	Name string
+}
+
+func (err *DuplicateComponentError) Error() string {
+	return fmt.Sprintf("rpg: duplicate component type %s", err.Name)
+}
+
+// UnregisteredComponentError is returned when a Component type is not in a Registry.
+type UnregisteredComponentError struct {
+	Name string
+}
+
+func (err *UnregisteredComponentError) Error() string {
+	return fmt.Sprintf("rpg: unregistered component type %s", err.Name)
+}
+
+// Register allows a ComponentFactory to be used with States that use r. It returns the
+// reflect.Type of the Component which can be used in Object.Component. The Component is
+// registered under its Go type name.
+func (r *Registry) Register(f ComponentFactory) (reflect.Type, error) {
+	return r.RegisterName(typeName(reflect.TypeOf(f(nil))), f)
+}
+
+// RegisterName is the same as Register, but the Component is encoded using the given
+// name and may be decoded using the name or any of the aliases. No name or alias may
+// already be in use by another Component type.
+func (r *Registry) RegisterName(name string, f ComponentFactory, aliases ...string) (reflect.Type, error) {
+	t := reflect.TypeOf(f(nil))
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.names[t]; ok {
+		return t, &DuplicateComponentError{Name: typeName(t)}
+	}
+	aliases = append(aliases[:len(aliases):len(aliases)], typeName(t))
+	if _, ok := r.aliases[name]; ok {
+		return t, &DuplicateComponentError{Name: name}
+	}
+	for _, alias := range aliases {
+		if _, ok := r.aliases[alias]; ok && alias != name {
+			return t, &DuplicateComponentError{Name: alias}
+		}
+	}
+
+	r.factories[name] = f
+	r.types[name] = t
+	r.names[t] = name
+	r.aliases[name] = name
+	for _, alias := range aliases {
+		r.aliases[alias] = name
+	}
+	return t, nil
+}
+
+// Unregister removes the ComponentFactory for the given type and its aliases from r. It
+// returns false if the type was not registered.
+func (r *Registry) Unregister(t reflect.Type) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	name, ok := r.names[t]
+	if !ok {
+		return false
+	}
+	delete(r.factories, name)
+	delete(r.types, name)
+	delete(r.names, t)
+	delete(r.migrations, t)
+	for alias, n := range r.aliases {
+		if n == name {
+			delete(r.aliases, alias)
+		}
+	}
+	return true
+}
+
+// Registered returns true if the given Component type is in r.
+func (r *Registry) Registered(t reflect.Type) bool {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	_, ok := r.names[t]
+	return ok
+}
+
+// Name returns the name the given Component type is encoded with.
+func (r *Registry) Name(t reflect.Type) (name string, ok bool) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	name, ok = r.names[t]
+	return
+}
+
+// KeepUnregistered sets whether States that use r keep the Components that are not in r
+// when they are decoded, instead of returning an *UnregisteredComponentError. The
+// Components are kept as *Opaque and are encoded again with their original name, which
+// allows tools to read and write States without importing the packages that define every
+// Component. Only Components that implement gob.GobEncoder can be kept.
+func (r *Registry) KeepUnregistered(keep bool) {
+	r.mtx.Lock()
+	r.keepUnregistered = keep
+	r.mtx.Unlock()
+}
+
+// keeps returns true if err is an *UnregisteredComponentError and r keeps unregistered
+// Components.
+func (r *Registry) keeps(err error) bool {
+	if _, ok := err.(*UnregisteredComponentError); !ok {
+		return false
+	}
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.keepUnregistered
+}
+
+// lookup returns the factory and type registered under name or an alias of name.
+func (r *Registry) lookup(name string) (ComponentFactory, reflect.Type, error) {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	f, ok := r.factories[r.aliases[name]]
+	if !ok {
+		return nil, nil, &UnregisteredComponentError{Name: name}
+	}
+	return f, r.types[r.aliases[name]], nil
+}
+
+// name returns the name t is encoded with, or an error if t is not in r.
+func (r *Registry) name(t reflect.Type) (string, error) {
+	name, ok := r.Name(t)
+	if !ok {
+		return "", &UnregisteredComponentError{Name: typeName(t)}
+	}
+	return name, nil
+}
@@ -0,0 +1,197 @@
+package rpg
+
+import (
+	"bytes"
+	"encoding/gob"
+	"strings"
+	"testing"
+)
+
+type registryTestComponent struct {
+	N int
+}
+
+func registryTestFactory(*Object) Component { return &registryTestComponent{} }
+
+func (c *registryTestComponent) Clone(*Object) Component {
+	clone := *c
+	return &clone
+}
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	if !r.Registered(ContainerType) {
+		t.Error("NewRegistry does not contain Container")
+	}
+	ct, err := r.Register(registryTestFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Register(registryTestFactory); err == nil {
+		t.Error("duplicate Register succeeded")
+	} else if _, ok := err.(*DuplicateComponentError); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if DefaultRegistry.Registered(ct) {
+		t.Error("Register modified DefaultRegistry")
+	}
+
+	s := NewStateWithRegistry(r)
+	var id ObjectIndex
+	if !s.Atomic(func(s *State) bool {
+		var o *Object
+		id, o = s.Create(registryTestFactory, ResourcesFactory)
+		o.Component(ct).(*registryTestComponent).N = 42
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		t.Fatal(err)
+	}
+	encoded := buf.Bytes()
+
+	decoded := NewStateWithRegistry(r)
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(decoded); err != nil {
+		t.Fatal(err)
+	}
+	if n := decoded.Get(id).Component(ct).(*registryTestComponent).N; n != 42 {
+		t.Errorf("expected 42, got %d", n)
+	}
+
+	err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(NewState())
+	if _, ok := err.(*UnregisteredComponentError); !ok {
+		t.Errorf("unexpected error decoding with DefaultRegistry: %v", err)
+	}
+
+	if !r.Unregister(ct) {
+		t.Error("Unregister failed")
+	}
+	if r.Unregister(ct) {
+		t.Error("second Unregister succeeded")
+	}
+	err = gob.NewDecoder(bytes.NewReader(encoded)).Decode(NewStateWithRegistry(r))
+	if _, ok := err.(*UnregisteredComponentError); !ok {
+		t.Errorf("unexpected error decoding after Unregister: %v", err)
+	}
+}
+
+func TestRegistryNames(t *testing.T) {
+	if name, ok := DefaultRegistry.Name(LocationType); !ok || name != "rpg.Location" {
+		t.Errorf("unexpected name for Location: %q", name)
+	}
+	if _, lt, err := DefaultRegistry.lookup(typeName(LocationType)); err != nil || lt != LocationType {
+		t.Errorf("Go type name of Location did not resolve: %v", err)
+	}
+
+	old := NewRegistry()
+	ct, err := old.RegisterName("test.Old", registryTestFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStateWithRegistry(old)
+	id := testCreate(t, s, registryTestFactory)
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s); err != nil {
+		t.Fatal(err)
+	}
+
+	renamed := NewRegistry()
+	if _, err := renamed.RegisterName("test.New", registryTestFactory, "test.Old"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := renamed.RegisterName("test.Other", ResourcesFactory); err == nil {
+		t.Error("registering a type twice succeeded")
+	}
+	if _, err := renamed.Register(func(*Object) Component { return new(Name) }); err == nil {
+		t.Error("registering a type twice succeeded")
+	}
+
+	s = NewStateWithRegistry(renamed)
+	if err := gob.NewDecoder(&buf).Decode(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Get(id).Component(ct) == nil {
+		t.Fatal("component was not decoded using its alias")
+	}
+	data, err := s.Get(id).GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("test.New")) || bytes.Contains(data, []byte("test.Old")) {
+		t.Error("component was not encoded using its new name")
+	}
+	aliases := make([]string, 1, 2)
+	aliases[0] = "test.Older"
+	if _, err := NewRegistry().RegisterName("test.Newer", registryTestFactory, aliases...); err != nil {
+		t.Fatal(err)
+	}
+	if extra := aliases[:2][1]; extra != "" {
+		t.Errorf("RegisterName modified the caller's aliases: %q", extra)
+	}
+}
+
+func TestRegistryKeepUnregistered(t *testing.T) {
+	global := NewState()
+	var id ObjectIndex
+	global.Atomic(func(s *State) bool {
+		var o *Object
+		id, o = s.Create(LocationFactory, NameFactory("rock"))
+		o.Component(LocationType).(*Location).Set(1, 2, 3)
+		return true
+	})
+	encoded := testEncodeState(t, global)
+	encodedJSON, err := global.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRegistry()
+	r.Unregister(LocationType)
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(NewStateWithRegistry(r)); err == nil {
+		t.Error("decoding an unregistered Component succeeded")
+	} else if _, ok := err.(*UnregisteredComponentError); !ok {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	r.KeepUnregistered(true)
+	kept := NewStateWithRegistry(r)
+	if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(kept); err != nil {
+		t.Fatal(err)
+	}
+	if o := kept.Get(id); o.Component(NameType) == nil || len(o.components) != 1 || o.opaque["rpg.Location"] == nil {
+		t.Errorf("unexpected components: %v %v", o.components, o.opaque)
+	}
+	keptJSON := NewStateWithRegistry(r)
+	if err := keptJSON.UnmarshalJSON(encodedJSON); err == nil {
+		t.Error("keeping a Component encoded as JSON succeeded")
+	} else if !strings.Contains(err.Error(), ErrJSONOpaque.Error()) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Modify the Object so the Opaque Component has to survive a commit.
+	kept.Atomic(func(s *State) bool {
+		*s.Get(id).Component(NameType).(*Name) = "stone"
+		s.Get(id).Modified()
+		return true
+	})
+	keptEncodedJSON, err := kept.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := keptJSON.UnmarshalJSON(keptEncodedJSON); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []*State{kept, keptJSON} {
+		decoded := testDecodeState(t, testEncodeState(t, s))
+		if x, y, z := decoded.Get(id).Component(LocationType).(*Location).Get(); x != 1 || y != 2 || z != 3 {
+			t.Errorf("expected (1, 2, 3), got (%d, %d, %d)", x, y, z)
+		}
+		if name := decoded.Get(id).Component(NameType).(*Name); *name != "stone" {
+			t.Errorf("expected stone, got %q", string(*name))
+		}
+	}
+}
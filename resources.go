@@ -5,7 +5,7 @@ type Resources struct {
 	o *Object
 }
 
-var ResourcesType = RegisterComponent(ResourcesFactory)
+var ResourcesType = registerBuiltin("rpg.Resources", ResourcesFactory)
 
 func ResourcesFactory(o *Object) Component {
 	return &Resources{
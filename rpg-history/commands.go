@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/Rnoadm/rpg"
+	"github.com/Rnoadm/rpg/history"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+var errUsage = errors.New("usage")
+
+// parseArgs parses the flags in fs, which may be nil, and returns the remaining arguments
+// if there are exactly n of them.
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	if fs != nil {
+		fs.Usage = func() {}
+		if err := fs.Parse(args); err != nil {
+			return nil, errUsage
+		}
+		args = fs.Args()
+	}
+	if len(args) != n {
+		return nil, errUsage
+	}
+	return args, nil
+}
+
+// open opens the history file called name for reading.
+func open(name string) (*history.History, *os.File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return history.NewHistory(f), f, nil
+}
+
+// parseFrame converts a FRAME argument to a frame index.
+func parseFrame(h *history.History, arg string) (int64, error) {
+	i, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid frame %q", arg)
+	}
+	n, err := h.Len()
+	if err != nil {
+		return 0, err
+	}
+	if i < 0 {
+		i += n
+	}
+	if i < 0 || i >= n {
+		return 0, fmt.Errorf("frame %s is out of range; there are %d frames", arg, n)
+	}
+	return i, nil
+}
+
+// seek returns the State at the frame given by arg.
+func seek(h *history.History, arg string) (*rpg.State, int64, error) {
+	i, err := parseFrame(h, arg)
+	if err != nil {
+		return nil, 0, err
+	}
+	s, err := h.Seek(i, history.SeekStart)
+	if err != nil {
+		return nil, 0, fmt.Errorf("frame %d: %v", i, err)
+	}
+	return s, i, nil
+}
+
+func formatTime(m *history.Metadata) string {
+	if m == nil || m.Time.IsZero() {
+		return "-"
+	}
+	return m.Time.Format(time.RFC3339)
+}
+
+func list(args []string) error {
+	args, err := parseArgs(nil, args, 1)
+	if err != nil {
+		return err
+	}
+	h, f, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	frames, err := h.Frames()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintln(w, "FRAME\tSIZE\tKEYFRAME\tTIME\tACTION")
+	for _, fi := range frames {
+		keyframe := ""
+		if fi.Keyframe {
+			keyframe = "yes"
+		}
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%v\n", fi.Index, fi.Size, keyframe, formatTime(fi.Metadata), fi.Metadata)
+	}
+	return w.Flush()
+}
+
+func info(args []string) error {
+	args, err := parseArgs(nil, args, 1)
+	if err != nil {
+		return err
+	}
+	h, f, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	frames, err := h.Frames()
+	if err != nil {
+		return err
+	}
+	size, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+
+	var keyframes, keyframeSize, patchSize, largest int64
+	for _, fi := range frames {
+		if fi.Keyframe {
+			keyframes++
+			keyframeSize += fi.Size
+		} else {
+			patchSize += fi.Size
+		}
+		if fi.Size > largest {
+			largest = fi.Size
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "file size:\t%d bytes\n", size)
+	fmt.Fprintf(w, "frames:\t%d\n", len(frames))
+	fmt.Fprintf(w, "keyframes:\t%d (%d bytes)\n", keyframes, keyframeSize)
+	fmt.Fprintf(w, "other frames:\t%d (%d bytes)\n", int64(len(frames))-keyframes, patchSize)
+	if len(frames) != 0 {
+		fmt.Fprintf(w, "average frame:\t%d bytes\n", (keyframeSize+patchSize)/int64(len(frames)))
+		fmt.Fprintf(w, "largest frame:\t%d bytes\n", largest)
+		fmt.Fprintf(w, "first time:\t%s\n", formatTime(frames[0].Metadata))
+		fmt.Fprintf(w, "last time:\t%s\n", formatTime(frames[len(frames)-1].Metadata))
+	}
+	return w.Flush()
+}
+
+// jsonState is the part of the JSON encoding of a State that is needed to print it.
+type jsonState struct {
+	Objects []struct {
+		ID         rpg.ObjectIndex            `json:"id"`
+		Parent     rpg.ObjectIndex            `json:"parent"`
+		Components map[string]json.RawMessage `json:"components"`
+	} `json:"objects"`
+}
+
+func sortedNames(m map[string]json.RawMessage) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "print the State as JSON")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+	h, f, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s, i, err := seek(h, args[1])
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		data, err := s.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err = json.Indent(&buf, data, "", "\t"); err != nil {
+			return err
+		}
+		buf.WriteByte('\n')
+		_, err = buf.WriteTo(os.Stdout)
+		return err
+	}
+
+	data, err := s.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	var js jsonState
+	if err = json.Unmarshal(data, &js); err != nil {
+		return err
+	}
+
+	m, err := h.Metadata(i)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("frame %d: %v (%s)\n", i, m, formatTime(m))
+	for _, o := range js.Objects {
+		if o.Parent != 0 {
+			fmt.Printf("object %d (parent %d)\n", o.ID, o.Parent)
+		} else {
+			fmt.Printf("object %d\n", o.ID)
+		}
+		for _, name := range sortedNames(o.Components) {
+			fmt.Printf("\t%s %s\n", name, o.Components[name])
+		}
+	}
+	return nil
+}
+
+func diff(args []string) error {
+	args, err := parseArgs(nil, args, 3)
+	if err != nil {
+		return err
+	}
+	h, f, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	a, _, err := seek(h, args[1])
+	if err != nil {
+		return err
+	}
+	b, _, err := seek(h, args[2])
+	if err != nil {
+		return err
+	}
+
+	diffs, err := rpg.Diff(a, b)
+	if err != nil {
+		return err
+	}
+	for _, d := range diffs {
+		fmt.Println(d.String())
+	}
+	return nil
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	states := fs.Bool("states", false, "also decode and validate the State of every frame")
+	args, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	h, f, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err = h.Verify(); err != nil {
+		return err
+	}
+
+	if *states {
+		for {
+			s, err := h.Seek(1, history.SeekCur)
+			if err == io.EOF {
+				break
+			}
+			if err == nil {
+				err = s.Validate()
+			}
+			if err != nil {
+				return &history.FrameError{Frame: h.Tell(), Err: err}
+			}
+		}
+	}
+
+	n, err := h.Len()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d frames ok\n", args[0], n)
+	return nil
+}
+
+func extract(args []string) (err error) {
+	args, err = parseArgs(nil, args, 3)
+	if err != nil {
+		return
+	}
+	h, f, err := open(args[0])
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	s, _, err := seek(h, args[1])
+	if err != nil {
+		return
+	}
+
+	out, err := os.OpenFile(args[2], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	return s.EncodeTo(out)
+}
+
+func compact(args []string) error {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	latest := fs.Int64("latest", 0, "keep only this many of the last frames")
+	every := fs.Int64("every", 0, "keep only every Nth frame")
+	before := fs.String("before", "", "drop frames from before this RFC 3339 time")
+	keyframes := fs.Int("keyframes", history.DefaultKeyframeInterval, "the number of frames between keyframes")
+	compress := fs.Bool("compress", false, "compress the frames")
+	args, err := parseArgs(fs, args, 2)
+	if err != nil {
+		return err
+	}
+
+	opt := history.CompactOptions{Latest: *latest, Every: *every}
+	if *before != "" {
+		if opt.Before, err = time.Parse(time.RFC3339, *before); err != nil {
+			return err
+		}
+	}
+
+	h, f, err := open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	out, err := os.OpenFile(args[1], os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	dst := history.NewHistory(out)
+	dst.KeyframeInterval = *keyframes
+	dst.Compress = *compress
+	if err = h.CompactTo(dst, opt); err != nil {
+		os.Remove(args[1])
+		return err
+	}
+
+	n, err := dst.Len()
+	if err != nil {
+		return err
+	}
+	size, err := out.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: %d frames, %d bytes\n", args[1], n, size)
+	return out.Sync()
+}
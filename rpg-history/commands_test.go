@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"github.com/Rnoadm/rpg"
+	"github.com/Rnoadm/rpg/history"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testOre is a Component that this command does not know about.
+type testOre struct {
+	amount byte
+}
+
+func (o *testOre) Clone(*rpg.Object) rpg.Component {
+	clone := *o
+	return &clone
+}
+
+func (o *testOre) GobEncode() ([]byte, error) { return []byte{o.amount}, nil }
+
+func (o *testOre) GobDecode(data []byte) error {
+	o.amount = data[0]
+	return nil
+}
+
+// testOutput returns what run wrote to os.Stdout.
+func testOutput(t *testing.T, run func(args []string) error, args ...string) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	out := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		io.Copy(&buf, r)
+		out <- buf.String()
+	}()
+
+	err = run(args)
+	os.Stdout = stdout
+	w.Close()
+	s := <-out
+	r.Close()
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+	return s
+}
+
+func TestUnregisteredComponents(t *testing.T) {
+	rpg.DefaultRegistry.KeepUnregistered(true)
+	defer rpg.DefaultRegistry.KeepUnregistered(false)
+
+	dir, err := ioutil.TempDir("", "rpg-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	game := rpg.NewRegistry()
+	oreFactory := func(*rpg.Object) rpg.Component { return &testOre{amount: 3} }
+	oreType, err := game.RegisterName("test.Ore", oreFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(dir, "game.sav")
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := history.NewHistoryWithRegistry(f, game)
+	s := rpg.NewStateWithRegistry(game)
+	var id rpg.ObjectIndex
+	s.Atomic(func(s *rpg.State) bool {
+		id, _ = s.Create(rpg.NameFactory("rock"), oreFactory)
+		return true
+	})
+	if err = h.Append(s); err != nil {
+		t.Fatal(err)
+	}
+	s.Atomic(func(s *rpg.State) bool {
+		s.Get(id).Component(oreType).(*testOre).amount = 5
+		s.Get(id).Modified()
+		return true
+	})
+	if err = h.Append(s); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if out := testOutput(t, dump, name, "0"); !strings.Contains(out, "\ttest.Ore ") || !strings.Contains(out, "\trpg.Name \"rock\"") {
+		t.Errorf("unexpected dump:\n%s", out)
+	}
+	if out := testOutput(t, diff, name, "0", "1"); out != "modified 1\n\ttest.Ore\n" {
+		t.Errorf("unexpected diff:\n%s", out)
+	}
+	testOutput(t, verify, "-states", name)
+
+	out := filepath.Join(dir, "frame.state")
+	testOutput(t, extract, name, "1", out)
+	f, err = os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	extracted := rpg.NewStateWithRegistry(game)
+	if err = extracted.DecodeFrom(f); err != nil {
+		t.Fatal(err)
+	}
+	if ore, ok := extracted.Get(id).Component(oreType).(*testOre); !ok || ore.amount != 5 {
+		t.Errorf("unexpected ore: %#v", ore)
+	}
+}
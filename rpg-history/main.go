@@ -0,0 +1,76 @@
+// Command rpg-history inspects files written by history.History.
+//
+// Usage:
+//
+//	rpg-history list FILE
+//	rpg-history info FILE
+//	rpg-history dump [-json] FILE FRAME
+//	rpg-history diff FILE FRAME FRAME
+//	rpg-history verify [-states] FILE
+//	rpg-history extract FILE FRAME OUT
+//	rpg-history compact [-latest N] [-every N] [-before TIME] [-keyframes N] [-compress] FILE OUT
+//
+// A FRAME is the index of a frame, starting at 0. Negative indices count back from the
+// end, so -1 is the last frame.
+//
+// Components that are not defined in package rpg are kept as opaque data, so dump prints
+// them as gob and diff only reports that they changed. extract and compact write them
+// back unchanged. This only works for Components that implement gob.GobEncoder.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/Rnoadm/rpg"
+	"os"
+)
+
+type command struct {
+	args string
+	run  func(args []string) error
+}
+
+var commands = map[string]command{
+	"list":    {"FILE", list},
+	"info":    {"FILE", info},
+	"dump":    {"[-json] FILE FRAME", dump},
+	"diff":    {"FILE FRAME FRAME", diff},
+	"verify":  {"[-states] FILE", verify},
+	"extract": {"FILE FRAME OUT", extract},
+	"compact": {"[-latest N] [-every N] [-before TIME] [-keyframes N] [-compress] FILE OUT", compact},
+}
+
+var commandOrder = []string{"list", "info", "dump", "diff", "verify", "extract", "compact"}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage:")
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "\trpg-history %s %s\n", name, commands[name].args)
+	}
+	os.Exit(2)
+}
+
+func main() {
+	rpg.DefaultRegistry.KeepUnregistered(true)
+
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+	}
+
+	c, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "rpg-history: unknown command %q\n", flag.Arg(0))
+		usage()
+	}
+
+	if err := c.run(flag.Args()[1:]); err != nil {
+		if err == errUsage {
+			fmt.Fprintf(os.Stderr, "usage: rpg-history %s %s\n", flag.Arg(0), c.args)
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "rpg-history %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
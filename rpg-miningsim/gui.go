@@ -7,10 +7,12 @@ import (
 	"image"
 	"io"
 	"strconv"
+	"time"
 )
 
 type Handler struct {
 	h              *history.History
+	branches       *history.Branches
 	s              *rpg.State
 	playerSprite   *image.RGBA
 	fontSprites    *image.RGBA
@@ -41,6 +43,7 @@ func (v *Handler) PreRender(w, h int) {
 
 func (v *Handler) SpriteAt(x, y, w, h int) (sprite *gui.Sprite) {
 	w2, h2 := w/2, h/2
+	frameTime := v.frameTime()
 
 	v.s.Atomic(func(s *rpg.State) bool {
 		player := s.Get(s.ByComponent(PlayerType)[0])
@@ -75,7 +78,7 @@ func (v *Handler) SpriteAt(x, y, w, h int) (sprite *gui.Sprite) {
 			sprite.Fg = gui.ColorRed
 			sprite.Bg = gui.ColorBlack
 		}
-		if h-1 == y && m.Len() != 0 && m.At(m.Len()-1).Time == v.h.Tell() {
+		if h-1 == y && m.Len() != 0 && m.At(m.Len()-1).Time == frameTime {
 			msg := []rune(m.At(m.Len() - 1).Text)
 			if x != 0 && x <= len(msg) {
 				if msg[x-1] >= 'a' && msg[x-1] <= 'z' {
@@ -128,9 +131,24 @@ func (v *Handler) Mouse(x, y, w, h int) {
 
 func (v *Handler) Rune(r rune) (handled bool) {
 	switch r {
+	case 'u':
+		v.seek(-1)
+		return true
+	case 'r':
+		v.seek(1)
+		return true
+	case 'b':
+		v.switchBranch()
+		return true
 	case 'p':
+		if *flagReplay > 0 {
+			return true
+		}
+
+		meta := &history.Metadata{Time: time.Now(), Label: "craft", Args: []string{"pickaxe"}}
 		v.s.Atomic(func(s *rpg.State) bool {
 			player := s.Get(s.ByComponent(PlayerType)[0])
+			meta.Actor = player.ID()
 			inventory := player.Component(rpg.ContainerType).(*rpg.Container)
 			ores := inventory.ByComponent(OreType)
 			if len(ores) == 0 {
@@ -138,20 +156,18 @@ func (v *Handler) Rune(r rune) (handled bool) {
 					Kind:   "error",
 					Source: player.ID(),
 					Text:   "no ores available",
-					Time:   v.h.Tell() + 1,
+					Time:   meta.Time.UnixNano(),
 				})
 				return true
 			}
 
-			ore := ores[0]
-			inventory.Remove(ore)
-			s.Delete(ore.ID())
+			s.Delete(ores[0].ID())
 			_, pickaxe := s.Create(PickaxeFactory, rpg.LocationFactory)
 			inventory.Add(pickaxe)
 
 			return true
 		})
-		v.h.Append(v.s)
+		v.record(meta)
 		return true
 	}
 	return false
@@ -181,8 +197,10 @@ func (v *Handler) moveCharacter(dx, dy int64) {
 		return
 	}
 
-	v.s.Atomic(func(s *rpg.State) bool {
+	meta := &history.Metadata{Time: time.Now()}
+	v.s.AtomicIsolation(rpg.Serializable, func(s *rpg.State) bool {
 		player := s.Get(s.ByComponent(PlayerType)[0])
+		meta.Actor = player.ID()
 
 		center := player.Component(rpg.LocationType).(*rpg.Location)
 
@@ -191,12 +209,14 @@ func (v *Handler) moveCharacter(dx, dy int64) {
 		x, y, z := center.Get()
 		x += dx
 		y += dy
+		meta.Args = []string{strconv.FormatInt(x, 10), strconv.FormatInt(y, 10), strconv.FormatInt(z, 10)}
 		if !minedLocations.Has(x, y, z) {
+			meta.Label = "mine"
 			container := player.Component(rpg.ContainerType).(*rpg.Container)
 			msg := &rpg.Message{
 				Kind:   "error",
 				Source: player.ID(),
-				Time:   v.h.Tell() + 1,
+				Time:   meta.Time.UnixNano(),
 				Text:   "no pickaxe in inventory",
 			}
 			for _, item := range container.ByComponent(PickaxeType) {
@@ -210,7 +230,7 @@ func (v *Handler) moveCharacter(dx, dy int64) {
 				msg = &rpg.Message{
 					Kind:   "error",
 					Source: item.ID(),
-					Time:   v.h.Tell() + 1,
+					Time:   meta.Time.UnixNano(),
 					Text:   err.Error(),
 				}
 			}
@@ -218,11 +238,109 @@ func (v *Handler) moveCharacter(dx, dy int64) {
 				player.Component(rpg.MessagesType).(*rpg.Messages).Append(*msg)
 			}
 		} else {
+			meta.Label = "move"
 			if center.Dist(x, y, z) == 1*1 {
 				center.Set(x, y, z)
 			}
 		}
 		return true
 	})
-	v.h.Append(v.s)
+	v.record(meta)
+}
+
+// seek undoes or redoes moves.
+func (v *Handler) seek(offset int64) {
+	if *flagReplay > 0 {
+		return
+	}
+
+	s, err := v.h.Seek(offset, history.SeekCur)
+	if err == io.EOF {
+		return
+	}
+	if err != nil {
+		panic(err)
+	}
+	v.s = s
+}
+
+// record appends the current state to the history. If moves were undone, the moves that
+// were undone are kept as a branch first. Save files from older versions of the game do not
+// support metadata, so it is left out for them.
+func (v *Handler) record(meta *history.Metadata) {
+	n, err := v.h.Len()
+	if err != nil {
+		panic(err)
+	}
+	if v.h.Tell() != n-1 {
+		if err = v.branches.Save(v.h, v.nextBranch()); err != nil {
+			panic(err)
+		}
+		if err = v.h.Truncate(); err != nil {
+			panic(err)
+		}
+	}
+	err = v.h.AppendWithMetadata(v.s, meta)
+	if err == history.ErrLegacy {
+		err = v.h.Append(v.s)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// frameTime returns the time of the frame at the cursor as the Time of a Message created
+// by the action that led to it, or -1 if the frame has no time.
+func (v *Handler) frameTime() int64 {
+	meta, err := v.h.Metadata(v.h.Tell())
+	if err != nil || meta == nil || meta.Time.IsZero() {
+		return -1
+	}
+	return meta.Time.UnixNano()
+}
+
+// switchBranch keeps the current history as a branch and continues from the oldest branch.
+func (v *Handler) switchBranch() {
+	if *flagReplay > 0 {
+		return
+	}
+
+	names, err := v.branches.List()
+	if err != nil {
+		panic(err)
+	}
+	if len(names) == 0 {
+		return
+	}
+	if err = v.branches.Save(v.h, v.nextBranch()); err != nil {
+		panic(err)
+	}
+	if err = v.branches.Load(v.h, names[0]); err != nil {
+		panic(err)
+	}
+	if err = v.branches.Remove(names[0]); err != nil {
+		panic(err)
+	}
+	s, err := v.h.Seek(0, history.SeekEnd)
+	if err != nil {
+		panic(err)
+	}
+	v.s = s
+}
+
+// nextBranch returns the lowest number that is not the name of a branch.
+func (v *Handler) nextBranch() string {
+	names, err := v.branches.List()
+	if err != nil {
+		panic(err)
+	}
+	used := make(map[string]bool, len(names))
+	for _, name := range names {
+		used[name] = true
+	}
+	for i := 1; ; i++ {
+		if name := strconv.Itoa(i); !used[name] {
+			return name
+		}
+	}
 }
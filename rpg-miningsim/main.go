@@ -18,6 +18,7 @@ import (
 var (
 	flagFilename = flag.String("f", "miningsim.sav", "filename for save file")
 	flagReplay   = flag.Duration("replay", 0, "play back the game up to this point with this delay between frames")
+	flagBranches = flag.Int("branches", 10, "number of undone futures to keep, or 0 to keep all of them")
 )
 
 func init() {
@@ -34,6 +35,12 @@ func main() {
 	defer f.Close()
 
 	h := history.NewHistory(f)
+	h.Sync = true
+	h.Compress = true
+	// Remove the last frame if the game crashed while saving it.
+	if _, err = h.Recover(); err != nil {
+		panic(err)
+	}
 	s, err := h.Seek(0, history.SeekEnd)
 	if err == io.EOF {
 		s = rpg.NewState()
@@ -51,7 +58,7 @@ func main() {
 			o.Component(rpg.ContainerType).(*rpg.Container).Add(pickaxe)
 			return true
 		})
-		err = h.Append(s)
+		err = h.AppendWithMetadata(s, &history.Metadata{Time: time.Now(), Label: "start"})
 	}
 	if err != nil {
 		panic(err)
@@ -73,8 +80,12 @@ func main() {
 		}(*flagReplay)
 	}
 
+	branches := history.NewBranches(*flagFilename)
+	branches.Max = *flagBranches
+
 	gui.Main("Mining Simulator 2014", &Handler{
 		h:              h,
+		branches:       branches,
 		s:              s,
 		playerSprite:   LoadImage(res.PlayerPng),
 		fontSprites:    LoadImage(res.FontPng),
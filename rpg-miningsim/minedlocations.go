@@ -16,7 +16,7 @@ func MinedLocationsFactory(o *rpg.Object) rpg.Component {
 	return &MinedLocations{l: make(map[[3]int64]bool), o: o}
 }
 
-var MinedLocationsType = rpg.RegisterComponent(MinedLocationsFactory)
+var MinedLocationsType = rpg.RegisterComponentName("miningsim.MinedLocations", MinedLocationsFactory)
 
 func (m *MinedLocations) Clone(o *rpg.Object) rpg.Component {
 	l := make(map[[3]int64]bool, len(m.l))
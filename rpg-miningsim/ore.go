@@ -8,7 +8,7 @@ func OreFactory(o *rpg.Object) rpg.Component {
 	return &Ore{}
 }
 
-var OreType = rpg.RegisterComponent(OreFactory)
+var OreType = rpg.RegisterComponentName("miningsim.Ore", OreFactory)
 
 func (p *Ore) Clone(o *rpg.Object) rpg.Component {
 	return &Ore{}
@@ -14,7 +14,7 @@ func PickaxeFactory(o *rpg.Object) rpg.Component {
 	return &Pickaxe{d: 10, o: o}
 }
 
-var PickaxeType = rpg.RegisterComponent(PickaxeFactory)
+var PickaxeType = rpg.RegisterComponentName("miningsim.Pickaxe", PickaxeFactory)
 
 func (p *Pickaxe) Clone(o *rpg.Object) rpg.Component {
 	return &Pickaxe{d: p.d, o: o}
@@ -24,6 +24,8 @@ var (
 	ErrCantReach     = errors.New("cannot reach target")
 	ErrPickaxeBroken = errors.New("pickaxe is broken")
 	ErrNoOreThere    = errors.New("no ore at target location")
+
+	ErrPickaxeEncoding = errors.New("invalid Pickaxe encoding")
 )
 
 func (p *Pickaxe) Use(x, y, z int64) (rpg.ObjectIndex, *rpg.Object, error) {
@@ -55,6 +57,9 @@ func (p *Pickaxe) GobEncode() (data []byte, err error) {
 	return
 }
 func (p *Pickaxe) GobDecode(data []byte) (err error) {
+	if len(data) != 1 {
+		return ErrPickaxeEncoding
+	}
 	p.d = data[0]
 	return
 }
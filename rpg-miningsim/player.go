@@ -8,7 +8,7 @@ func PlayerFactory(o *rpg.Object) rpg.Component {
 	return &Player{}
 }
 
-var PlayerType = rpg.RegisterComponent(PlayerFactory)
+var PlayerType = rpg.RegisterComponentName("miningsim.Player", PlayerFactory)
 
 func (p *Player) Clone(o *rpg.Object) rpg.Component {
 	return &Player{}
@@ -0,0 +1,110 @@
+package rpg
+
+import "sort"
+
+// chunkShift is the base 2 logarithm of the size of a chunk of the spatial index.
+const chunkShift = 4
+
+type chunk [3]int64
+
+func chunkOf(l *Location) chunk {
+	return chunk{l.x >> chunkShift, l.y >> chunkShift, l.z >> chunkShift}
+}
+
+// spatialAdd adds an Object to the spatial index of a root State. s.mtx must be held.
+func (s *State) spatialAdd(id ObjectIndex, l *Location) {
+	c := chunkOf(l)
+	b := s.spatial[c]
+	b.add(id)
+	s.spatial[c] = b
+}
+
+// spatialRemove removes an Object from the spatial index of a root State. s.mtx must be
+// held.
+func (s *State) spatialRemove(id ObjectIndex, l *Location) {
+	c := chunkOf(l)
+	b := s.spatial[c]
+	b.remove(id)
+	if len(b) == 0 {
+		delete(s.spatial, c)
+	} else {
+		s.spatial[c] = b
+	}
+}
+
+// At returns the sorted set of IDs of Objects that have a Location at (x, y, z).
+func (s *State) At(x, y, z int64) []ObjectIndex {
+	return s.WithinBox(x, y, z, x, y, z)
+}
+
+// WithinBox returns the sorted set of IDs of Objects that have a Location (x, y, z) with
+// x0 ≤ x ≤ x1, y0 ≤ y ≤ y1, and z0 ≤ z ≤ z1.
+func (s *State) WithinBox(x0, y0, z0, x1, y1, z1 int64) []ObjectIndex {
+	return []ObjectIndex(s.locate(x0, y0, z0, x1, y1, z1, nil))
+}
+
+// WithinRadius returns the sorted set of IDs of Objects that have a Location l with
+// l.Dist(x, y, z) ≤ r*r.
+func (s *State) WithinRadius(x, y, z, r int64) []ObjectIndex {
+	return []ObjectIndex(s.locate(x-r, y-r, z-r, x+r, y+r, z+r, func(l *Location) bool {
+		return l.Dist(x, y, z) <= r*r
+	}))
+}
+
+func (s *State) locate(x0, y0, z0, x1, y1, z1 int64, match func(*Location) bool) sortedObjectIndices {
+	matches := func(o *Object) bool {
+		l, ok := o.components[LocationType].(*Location)
+		if !ok || l.x < x0 || l.x > x1 || l.y < y0 || l.y > y1 || l.z < z0 || l.z > z1 {
+			return false
+		}
+		return match == nil || match(l)
+	}
+
+	return s.overlay(func(root *State) sortedObjectIndices {
+		var ids sortedObjectIndices
+		check := func(b sortedObjectIndices) {
+			for _, id := range b {
+				if o := root.objects[id]; o != nil && matches(o) {
+					ids = append(ids, id)
+				}
+			}
+		}
+
+		lo := chunk{x0 >> chunkShift, y0 >> chunkShift, z0 >> chunkShift}
+		hi := chunk{x1 >> chunkShift, y1 >> chunkShift, z1 >> chunkShift}
+		if chunkCount(lo, hi) > uint64(len(root.spatial)) {
+			for c, b := range root.spatial {
+				if c[0] >= lo[0] && c[0] <= hi[0] && c[1] >= lo[1] && c[1] <= hi[1] && c[2] >= lo[2] && c[2] <= hi[2] {
+					check(b)
+				}
+			}
+		} else {
+			for cx := lo[0]; cx <= hi[0]; cx++ {
+				for cy := lo[1]; cy <= hi[1]; cy++ {
+					for cz := lo[2]; cz <= hi[2]; cz++ {
+						check(root.spatial[chunk{cx, cy, cz}])
+					}
+				}
+			}
+		}
+		sort.Sort(ids)
+		return ids
+	}, matches)
+}
+
+// chunkCount returns the number of chunks between lo and hi, inclusive, saturating at the
+// maximum uint64.
+func chunkCount(lo, hi chunk) uint64 {
+	count := uint64(1)
+	for i := range lo {
+		if hi[i] < lo[i] {
+			return 0
+		}
+		n := uint64(hi[i]-lo[i]) + 1
+		if n == 0 || count > ^uint64(0)/n {
+			return ^uint64(0)
+		}
+		count *= n
+	}
+	return count
+}
@@ -0,0 +1,97 @@
+package rpg
+
+import (
+	"math"
+	"testing"
+)
+
+func testLocated(t *testing.T, s *State, x, y, z int64) ObjectIndex {
+	var id ObjectIndex
+	if !s.Atomic(func(s *State) bool {
+		var o *Object
+		id, o = s.Create(LocationFactory)
+		o.Component(LocationType).(*Location).Set(x, y, z)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	return id
+}
+
+func testIDs(t *testing.T, name string, ids []ObjectIndex, expected ...ObjectIndex) {
+	if !equalIDs(ids, expected) {
+		t.Errorf("%s: expected %v, got %v", name, expected, ids)
+	}
+}
+
+func TestSpatial(t *testing.T) {
+	global := NewState()
+	a := testLocated(t, global, 0, 0, 0)
+	b := testLocated(t, global, 1, 0, 0)
+	c := testLocated(t, global, -1, -1, 0)
+	d := testLocated(t, global, 100, -100, 5)
+	e := testLocated(t, global, -17, 16, 0)
+
+	testIDs(t, "At", global.At(0, 0, 0), a)
+	testIDs(t, "At", global.At(-1, -1, 0), c)
+	testIDs(t, "At", global.At(-1, 0, 0))
+	testIDs(t, "WithinBox", global.WithinBox(-1, -1, 0, 1, 1, 0), a, b, c)
+	testIDs(t, "WithinBox", global.WithinBox(-20, 0, 0, 0, 20, 0), a, e)
+	testIDs(t, "WithinBox", global.WithinBox(math.MinInt64, math.MinInt64, math.MinInt64, math.MaxInt64, math.MaxInt64, math.MaxInt64), a, b, c, d, e)
+	testIDs(t, "WithinRadius", global.WithinRadius(0, 0, 0, 1), a, b)
+	testIDs(t, "WithinRadius", global.WithinRadius(0, 0, 0, 2), a, b, c)
+	testIDs(t, "WithinRadius", global.WithinRadius(100, -100, 0, 5), d)
+}
+
+func TestSpatialAtomic(t *testing.T) {
+	global := NewState()
+	a := testLocated(t, global, 0, 0, 0)
+	b := testLocated(t, global, 1, 0, 0)
+	c := testLocated(t, global, 2, 0, 0)
+
+	var d ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		s.Get(a).Component(LocationType).(*Location).Set(50, 50, 50)
+		s.Delete(b)
+		s.Get(c).RemoveComponent(LocationType)
+		var o *Object
+		d, o = s.Create(LocationFactory)
+		o.Component(LocationType).(*Location).Set(1, 0, 0)
+
+		testIDs(t, "At", s.At(0, 0, 0))
+		testIDs(t, "At", s.At(1, 0, 0), d)
+		testIDs(t, "WithinRadius", s.WithinRadius(0, 0, 0, 10), d)
+		testIDs(t, "WithinRadius", s.WithinRadius(50, 50, 50, 0), a)
+		testIDs(t, "WithinRadius", global.WithinRadius(0, 0, 0, 10), a, b, c)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	testIDs(t, "WithinRadius", global.WithinRadius(0, 0, 0, 10), d)
+	testIDs(t, "WithinBox", global.WithinBox(0, 0, 0, 50, 50, 50), a, d)
+	testIDs(t, "At", global.At(50, 50, 50), a)
+}
+
+func TestSpatialContainer(t *testing.T) {
+	global := NewState()
+	bag := testLocated(t, global, 0, 0, 0)
+	item := testLocated(t, global, 5, 5, 5)
+
+	if !global.Atomic(func(s *State) bool {
+		s.Get(bag).AddComponent(ContainerFactory).(*Container).Add(s.Get(item))
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	testIDs(t, "At", global.At(0, 0, 0), bag, item)
+
+	if !global.Atomic(func(s *State) bool {
+		s.Get(bag).Component(LocationType).(*Location).Set(-40, 0, 0)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	testIDs(t, "At", global.At(0, 0, 0))
+	testIDs(t, "At", global.At(-40, 0, 0), bag, item)
+}
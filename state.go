@@ -11,36 +11,77 @@ import (
 // State represents a set of Object that can be modified concurrently using compare-and-set.
 type State struct {
 	parent       *State
+	registry     *Registry
 	objects      map[ObjectIndex]*Object
-	by_component map[reflect.Type][]ObjectIndex
+	by_component map[reflect.Type]sortedObjectIndices
+	referrers    map[ObjectIndex]sortedObjectIndices
+	spatial      map[chunk]sortedObjectIndices
 	mtx          sync.Mutex
 
-	nextObjectID, nextObjectVersion *uint64
+	nextObjectID, nextObjectVersion, componentsVersion *uint64
+
+	// componentSetsChanged is set in a child State when an Object gained or lost a
+	// Component, so that committing the child invalidates the Container indices of the
+	// parent.
+	componentSetsChanged bool
 
 	deleted        map[ObjectIndex]uint64
 	deletedVersion uint64
+
+	// deletedLocal holds the localBase of the Objects deleted from a child State.
+	deletedLocal map[ObjectIndex]uint64
+
+	// recreated holds the Objects that were deleted from the parent State and created
+	// again in this one by Delta.Apply, with the version they were deleted at.
+	recreated map[ObjectIndex]uint64
+
+	isolation Isolation
+	reads     map[ObjectIndex]uint64
+
+	migrations []string
+
+	subscribers    map[uint64]func(*ChangeSet)
+	nextSubscriber uint64
+	commits        uint64
+	delivered      uint64
+	notifyMtx      sync.Mutex
+	notifyCond     sync.Cond
 }
 
-// NewState initializes an empty State.
+// NewState initializes an empty State that uses DefaultRegistry.
 func NewState() *State {
 	return newState(nil)
 }
 
+// NewStateWithRegistry initializes an empty State that uses the given Registry. Child
+// States use the same Registry, as does GobDecode.
+func NewStateWithRegistry(r *Registry) *State {
+	s := newState(nil)
+	s.registry = r
+	return s
+}
+
 func newState(parent *State) *State {
 	s := &State{
-		parent:       parent,
-		objects:      make(map[ObjectIndex]*Object),
-		by_component: make(map[reflect.Type][]ObjectIndex),
-		deleted:      make(map[ObjectIndex]uint64),
+		parent:  parent,
+		objects: make(map[ObjectIndex]*Object),
+		deleted: make(map[ObjectIndex]uint64),
+		reads:   make(map[ObjectIndex]uint64),
 	}
 	if parent == nil {
-		var a [2]uint64
-		s.nextObjectID, s.nextObjectVersion = &a[0], &a[1]
+		var a [3]uint64
+		s.nextObjectID, s.nextObjectVersion, s.componentsVersion = &a[0], &a[1], &a[2]
+		s.by_component = make(map[reflect.Type]sortedObjectIndices)
+		s.referrers = make(map[ObjectIndex]sortedObjectIndices)
+		s.spatial = make(map[chunk]sortedObjectIndices)
+		s.notifyCond.L = &s.notifyMtx
 	} else {
-		s.nextObjectID, s.nextObjectVersion = parent.nextObjectID, parent.nextObjectVersion
+		s.nextObjectID, s.nextObjectVersion, s.componentsVersion = parent.nextObjectID, parent.nextObjectVersion, parent.componentsVersion
+		s.registry = parent.registry
 		parent.mtx.Lock()
 		defer parent.mtx.Unlock()
 
+		s.isolation = parent.isolation
 		s.deletedVersion = parent.deletedVersion
 		for id, v := range parent.deleted {
 			s.deleted[id] = v
@@ -49,101 +90,26 @@ func newState(parent *State) *State {
 	return s
 }
 
-// Atomic calls f and tries to apply its changes. This is the only way a State should be
-// modified. f may be called multiple times if other calls to Atomic are being processed
-// at the same time. Returning false from f causes Atomic to return false without
-// applying the changes.
-//
-// This does not currently work recursively, but it may in the future.
-func (s *State) Atomic(f func(*State) bool) bool {
-	// TODO: make this work recursively
-
-	for {
-		child := newState(s)
-		if !f(child) {
-			return false
-		}
-
-		if func() bool {
-			child.mtx.Lock()
-			defer child.mtx.Unlock()
-
-			s.mtx.Lock()
-			defer s.mtx.Unlock()
-
-			if child.deletedVersion != s.deletedVersion {
-				for id, v1 := range s.deleted {
-					if v2, ok := child.deleted[id]; !ok || v1 != v2 {
-						return false
-					}
-				}
-			}
-
-			var newlyDeleted []ObjectIndex
-
-			for id, o := range child.objects {
-				if o == nil {
-					if p, ok := s.objects[id]; ok && p != nil {
-						if child.deleted[id] != p.version {
-							return false
-						}
-						newlyDeleted = append(newlyDeleted, id)
-					}
-					continue
-				}
-				if !o.modified {
-					continue
-				}
-				if p, ok := s.objects[id]; ok && p.version != o.version {
-					return false
-				}
-			}
-
-			for id, o := range child.objects {
-				if o == nil {
-					s.objects[id] = nil
-					continue
-				}
-				if !o.modified {
-					continue
-				}
-				o.version = atomic.AddUint64(s.nextObjectVersion, 1)
-				s.objects[id] = o
-			}
-			for t, m := range child.by_component {
-				s.by_component[t] = append(s.by_component[t], m...)
-			}
-			if len(newlyDeleted) != 0 {
-				for t, m := range s.by_component {
-					ids := sortedObjectIndices(m)
-					sort.Sort(ids)
-					removed := false
-					for _, id := range newlyDeleted {
-						if ids.remove(id) {
-							removed = true
-						}
-					}
-					if removed {
-						s.by_component[t] = []ObjectIndex(ids)
-					}
-				}
-			}
-			s.deleted = child.deleted
-			s.deletedVersion = child.deletedVersion
-			return true
-		}() {
-			return true
-		}
+// Registry returns the Registry used by s.
+func (s *State) Registry() *Registry {
+	if s.registry == nil {
+		return DefaultRegistry
 	}
+	return s.registry
 }
 
 // Create initializes a new Object and returns it and its ObjectIndex. The factories
 // must not be duplicate and must be pre-registered. The id is unique for all Objects
 // in this State heirarchy.
 func (s *State) Create(factories ...ComponentFactory) (id ObjectIndex, o *Object) {
+	return s.create(0, factories)
+}
+
+func (s *State) create(parent ObjectIndex, factories []ComponentFactory) (id ObjectIndex, o *Object) {
 	id = ObjectIndex(atomic.AddUint64(s.nextObjectID, 1))
 	o = &Object{
 		id:         id,
+		parent:     parent,
 		components: make(map[reflect.Type]Component, len(factories)),
 		version:    atomic.AddUint64(s.nextObjectVersion, 1),
 		modified:   true,
@@ -151,21 +117,13 @@ func (s *State) Create(factories ...ComponentFactory) (id ObjectIndex, o *Object
 	}
 
 	for _, f := range factories {
-		c := f(o)
-		t := reflect.TypeOf(c)
-		if _, ok := registeredComponents[typeName(t)]; !ok {
-			panic("rpg: unregistered component type " + t.String())
-		}
-		if _, ok := o.components[t]; ok {
-			panic("rpg: multiple components of type " + t.String())
-		}
-		o.components[t] = c
+		o.addComponent(f)
 	}
 
 	s.mtx.Lock()
 	s.objects[id] = o
-	for t := range o.components {
-		s.by_component[t] = append(s.by_component[t], id)
+	if s.parent == nil {
+		s.reindex(id, nil, o)
 	}
 	s.mtx.Unlock()
 
@@ -186,8 +144,14 @@ func (s *State) Get(id ObjectIndex) *Object {
 
 	o := s.parent.Get(id)
 	if o == nil {
+		if s.isolation == Serializable {
+			s.reads[id] = 0
+		}
 		return nil
 	}
+	if s.isolation == Serializable {
+		s.reads[id] = o.version
+	}
 
 	o = o.clone(s)
 	s.objects[id] = o
@@ -195,19 +159,24 @@ func (s *State) Get(id ObjectIndex) *Object {
 	return o
 }
 
-// Delete removes an object from the State. Future calls to Get will return nil. If the
-// object is referenced anywhere, Bad Things™ will happen.
+// Delete removes an object from the State. Future calls to Get will return nil. It is the
+// same as DeleteWith using DeleteNullify.
 func (s *State) Delete(id ObjectIndex) {
-	o := s.Get(id)
-	if o == nil {
-		return
-	}
+	s.DeleteWith(id, DeleteNullify)
+}
 
+func (s *State) delete(id ObjectIndex, o *Object) {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
+	if s.parent == nil {
+		s.reindex(id, o, nil)
+	}
 	s.objects[id] = nil
 	s.deleted[id] = o.version
+	if s.parent != nil {
+		s.addDeletedLocal(id, o.localBase)
+	}
 	s.deletedVersion = atomic.AddUint64(s.nextObjectVersion, 1)
 }
 
@@ -256,21 +225,191 @@ func (s *State) hasID(id ObjectIndex) bool {
 
 // ByComponent returns a sorted set of IDs of objects that have the given component type.
 func (s *State) ByComponent(t reflect.Type) []ObjectIndex {
-	ids := s.byComponent(t)
-	sort.Sort(sortedObjectIndices(ids))
-	return ids
+	return []ObjectIndex(s.byComponent(t))
+}
+
+func (s *State) byComponent(t reflect.Type) sortedObjectIndices {
+	return s.overlay(func(root *State) sortedObjectIndices {
+		return append(sortedObjectIndices(nil), root.by_component[t]...)
+	}, func(o *Object) bool {
+		_, ok := o.components[t]
+		return ok
+	})
 }
 
-func (s *State) byComponent(t reflect.Type) []ObjectIndex {
+// overlay returns the result of an index lookup in a State hierarchy. fromRoot looks up
+// the IDs in the index of the root State, and each child State replaces the entries for
+// the Objects it has created, deleted, or retrieved with the ones for which match returns
+// true. fromRoot is called with the root's mtx held and must return a slice it owns.
+func (s *State) overlay(fromRoot func(root *State) sortedObjectIndices, match func(*Object) bool) sortedObjectIndices {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	var ids []ObjectIndex
+	if s.parent == nil {
+		return fromRoot(s)
+	}
+
+	ids := s.parent.overlay(fromRoot, match)
+	n := 0
+	for _, id := range ids {
+		if _, ok := s.objects[id]; !ok {
+			ids[n] = id
+			n++
+		}
+	}
+	ids = ids[:n]
+	for id, o := range s.objects {
+		if o != nil && match(o) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(ids)
+
+	return ids
+}
+
+// reindex updates the indices of a root State after the Object with the given id changed
+// from old to o. Either may be nil. s.mtx must be held.
+func (s *State) reindex(id ObjectIndex, old, o *Object) {
+	var oldRefs, newRefs sortedObjectIndices
+	if old != nil {
+		oldRefs = old.references()
+	}
+	if o != nil {
+		newRefs = o.references()
+	}
+	for _, ref := range oldRefs {
+		if !newRefs.has(ref) {
+			b := s.referrers[ref]
+			b.remove(id)
+			if len(b) == 0 {
+				delete(s.referrers, ref)
+			} else {
+				s.referrers[ref] = b
+			}
+		}
+	}
+	for _, ref := range newRefs {
+		if !oldRefs.has(ref) {
+			b := s.referrers[ref]
+			b.add(id)
+			s.referrers[ref] = b
+		}
+	}
+
+	var oldLoc, newLoc *Location
+	if old != nil {
+		oldLoc, _ = old.components[LocationType].(*Location)
+	}
+	if o != nil {
+		newLoc, _ = o.components[LocationType].(*Location)
+	}
+	if oldLoc == nil || newLoc == nil || chunkOf(oldLoc) != chunkOf(newLoc) {
+		if oldLoc != nil {
+			s.spatialRemove(id, oldLoc)
+		}
+		if newLoc != nil {
+			s.spatialAdd(id, newLoc)
+		}
+	}
+
+	if old != nil && o != nil && !sameComponentTypes(old, o) {
+		// A Container index built since the Component was added or removed, but
+		// before it was committed, would otherwise be cached with the old sets.
+		atomic.AddUint64(s.componentsVersion, 1)
+	}
+
+	if old != nil {
+		for t := range old.components {
+			if o != nil {
+				if _, ok := o.components[t]; ok {
+					continue
+				}
+			}
+			b := s.by_component[t]
+			b.remove(id)
+			s.by_component[t] = b
+		}
+	}
+	if o != nil {
+		for t := range o.components {
+			if old != nil {
+				if _, ok := old.components[t]; ok {
+					continue
+				}
+			}
+			b := s.by_component[t]
+			b.add(id)
+			s.by_component[t] = b
+		}
+	}
+}
+
+// componentsChanged records that the Object with the given id gained or lost the Component
+// c of type t outside of Create.
+func (s *State) componentsChanged(id ObjectIndex, t reflect.Type, c Component, added bool) {
+	atomic.AddUint64(s.componentsVersion, 1)
+
 	if s.parent != nil {
-		ids = s.parent.byComponent(t)
+		// Child States are reindexed when they are committed to the root.
+		s.mtx.Lock()
+		s.componentSetsChanged = true
+		s.mtx.Unlock()
+		return
 	}
 
-	return append(ids, s.by_component[t]...)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	b := s.by_component[t]
+	if added {
+		b.add(id)
+	} else {
+		b.remove(id)
+	}
+	s.by_component[t] = b
+
+	if l, ok := c.(*Location); ok {
+		if added {
+			s.spatialAdd(id, l)
+		} else {
+			s.spatialRemove(id, l)
+		}
+	}
+}
+
+// sameComponentTypes returns true if a and b have Components of the same types.
+func sameComponentTypes(a, b *Object) bool {
+	if len(a.components) != len(b.components) {
+		return false
+	}
+	for t := range a.components {
+		if _, ok := b.components[t]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// addDeletedLocal records the localBase of an Object deleted from s. s.mtx must be held.
+func (s *State) addDeletedLocal(id ObjectIndex, base uint64) {
+	if s.deletedLocal == nil {
+		s.deletedLocal = make(map[ObjectIndex]uint64)
+	}
+	s.deletedLocal[id] = base
+}
+
+// addRecreated records that the Object with the given id, deleted at version v, was
+// created again. Only the first version is kept, as it is the one the parent State
+// deleted. s.mtx must be held.
+func (s *State) addRecreated(id ObjectIndex, v uint64) {
+	if _, ok := s.recreated[id]; ok {
+		return
+	}
+	if s.recreated == nil {
+		s.recreated = make(map[ObjectIndex]uint64)
+	}
+	s.recreated[id] = v
 }
 
 func (s *State) clearDeleted() {
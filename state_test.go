@@ -0,0 +1,351 @@
+package rpg
+
+import "testing"
+
+func testResources(t *testing.T, s *State, id ObjectIndex, key string, expected int64) {
+	o := s.Get(id)
+	if o == nil {
+		t.Errorf("object %d does not exist", id)
+		return
+	}
+	if v := o.Component(ResourcesType).(*Resources).Get(key); v != expected {
+		t.Errorf("object %d: %q is %d, expected %d", id, key, v, expected)
+	}
+}
+
+func testCreate(t testing.TB, s *State, factories ...ComponentFactory) (id ObjectIndex) {
+	if !s.Atomic(func(s *State) bool {
+		id, _ = s.Create(factories...)
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	return
+}
+
+func TestAtomicNestedCommit(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+
+	var b ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		if !s.Atomic(func(s *State) bool {
+			s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 10)
+			return true
+		}) {
+			t.Error("inner Atomic failed")
+		}
+		testResources(t, s, a, "gold", 10)
+		testResources(t, global, a, "gold", 0)
+
+		if !s.Atomic(func(s *State) bool {
+			var o *Object
+			b, o = s.Create(ResourcesFactory)
+			o.Component(ResourcesType).(*Resources).Set("gold", 5)
+			return true
+		}) {
+			t.Error("inner Atomic failed")
+		}
+		testResources(t, s, b, "gold", 5)
+		if global.Get(b) != nil {
+			t.Error("inner Create visible outside of outer Atomic")
+		}
+		return true
+	}) {
+		t.Fatal("outer Atomic failed")
+	}
+
+	testResources(t, global, a, "gold", 10)
+	testResources(t, global, b, "gold", 5)
+	if ids := global.ByComponent(ResourcesType); len(ids) != 2 || ids[0] != a || ids[1] != b {
+		t.Errorf("unexpected ByComponent result: %v", ids)
+	}
+}
+
+func TestAtomicNestedRollback(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+	b := testCreate(t, global, ResourcesFactory)
+
+	var c ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 1)
+
+		if s.Atomic(func(s *State) bool {
+			s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 100)
+			s.Delete(b)
+			c, _ = s.Create(ResourcesFactory)
+			return false
+		}) {
+			t.Error("inner Atomic succeeded")
+		}
+
+		testResources(t, s, a, "gold", 1)
+		if s.Get(b) == nil {
+			t.Error("inner Delete was not rolled back")
+		}
+		if s.Get(c) != nil {
+			t.Error("inner Create was not rolled back")
+		}
+		return true
+	}) {
+		t.Fatal("outer Atomic failed")
+	}
+
+	testResources(t, global, a, "gold", 1)
+	testResources(t, global, b, "gold", 0)
+	if global.Get(c) != nil {
+		t.Error("inner Create was not rolled back")
+	}
+	if ids := global.ByComponent(ResourcesType); len(ids) != 2 {
+		t.Errorf("unexpected ByComponent result: %v", ids)
+	}
+}
+
+func TestAtomicNestedCreateDelete(t *testing.T) {
+	global := NewState()
+
+	var a ObjectIndex
+	if !global.Atomic(func(s *State) bool {
+		if !s.Atomic(func(s *State) bool {
+			a, _ = s.Create(ResourcesFactory)
+			return true
+		}) {
+			t.Error("inner Atomic failed")
+		}
+		if !s.Atomic(func(s *State) bool {
+			s.Delete(a)
+			return true
+		}) {
+			t.Error("inner Atomic failed")
+		}
+		return true
+	}) {
+		t.Fatal("outer Atomic failed")
+	}
+
+	if global.Get(a) != nil {
+		t.Error("deleted object still exists")
+	}
+	if ids := global.ByComponent(ResourcesType); len(ids) != 0 {
+		t.Errorf("unexpected ByComponent result: %v", ids)
+	}
+	if ids := global.IDs(); len(ids) != 0 {
+		t.Errorf("unexpected IDs result: %v", ids)
+	}
+}
+
+// testNestedConflict runs inner inside a nested Atomic. During the first attempt,
+// concurrent is committed directly to the root State before the outer Atomic returns.
+func testNestedConflict(t *testing.T, global *State, inner, concurrent func(*State) bool) (attempts int) {
+	if !global.Atomic(func(s *State) bool {
+		attempts++
+		if !s.Atomic(inner) {
+			t.Error("inner Atomic failed")
+		}
+		if attempts == 1 && !global.Atomic(concurrent) {
+			t.Error("concurrent Atomic failed")
+		}
+		return true
+	}) {
+		t.Fatal("outer Atomic failed")
+	}
+	return
+}
+
+func TestAtomicNestedModifyConflict(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+
+	attempts := testNestedConflict(t, global, func(s *State) bool {
+		r := s.Get(a).Component(ResourcesType).(*Resources)
+		r.Set("gold", r.Get("gold")+1)
+		return true
+	}, func(s *State) bool {
+		r := s.Get(a).Component(ResourcesType).(*Resources)
+		r.Set("gold", r.Get("gold")+10)
+		return true
+	})
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	testResources(t, global, a, "gold", 11)
+}
+
+// testSiblingConflict runs inner inside a nested Atomic. During the first attempt,
+// sibling is committed to the same outer State by another nested Atomic before inner
+// returns.
+func testSiblingConflict(t *testing.T, global *State, inner, sibling func(*State) bool) (attempts int) {
+	if !global.Atomic(func(s *State) bool {
+		attempts = 0
+		return s.Atomic(func(s2 *State) bool {
+			attempts++
+			if !inner(s2) {
+				return false
+			}
+			if attempts == 1 && !s.Atomic(sibling) {
+				t.Error("sibling Atomic failed")
+			}
+			return true
+		})
+	}) {
+		t.Fatal("outer Atomic failed")
+	}
+	return
+}
+
+func TestAtomicNestedSiblingConflict(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory, LocationFactory)
+
+	attempts := testSiblingConflict(t, global, func(s *State) bool {
+		s.Get(a).Component(LocationType).(*Location).Set(1, 2, 3)
+		return true
+	}, func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 7)
+		return true
+	})
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	testResources(t, global, a, "gold", 7)
+	if x, y, z := global.Get(a).Component(LocationType).(*Location).Get(); x != 1 || y != 2 || z != 3 {
+		t.Errorf("expected (1, 2, 3), got (%d, %d, %d)", x, y, z)
+	}
+
+	attempts = testSiblingConflict(t, global, func(s *State) bool {
+		s.Delete(a)
+		return true
+	}, func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 8)
+		return true
+	})
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	if global.Get(a) != nil {
+		t.Error("deleted object still exists")
+	}
+}
+
+func TestAtomicNestedDeleteConflict(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+
+	attempts := testNestedConflict(t, global, func(s *State) bool {
+		s.Delete(a)
+		return true
+	}, func(s *State) bool {
+		s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 10)
+		return true
+	})
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	if global.Get(a) != nil {
+		t.Error("deleted object still exists")
+	}
+}
+
+func TestAtomicNestedModifyDeletedConflict(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+	b := testCreate(t, global, ResourcesFactory)
+
+	attempts := testNestedConflict(t, global, func(s *State) bool {
+		if o := s.Get(a); o != nil {
+			o.Component(ResourcesType).(*Resources).Set("gold", 10)
+		}
+		s.Get(b).Component(ResourcesType).(*Resources).Set("gold", 10)
+		return true
+	}, func(s *State) bool {
+		s.Delete(a)
+		return true
+	})
+
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+	if global.Get(a) != nil {
+		t.Error("deleted object exists again")
+	}
+	testResources(t, global, b, "gold", 10)
+}
+
+// testWriteSkew reads a and writes b. During the first attempt, a is modified directly in
+// the root State before the Atomic returns.
+func testWriteSkew(t *testing.T, atomic func(*State, func(*State) bool) bool) (attempts int) {
+	global := NewState()
+	a := testCreate(t, global, ResourcesFactory)
+	b := testCreate(t, global, ResourcesFactory)
+
+	if !atomic(global, func(s *State) bool {
+		attempts++
+		gold := s.Get(a).Component(ResourcesType).(*Resources).Get("gold")
+		s.Get(b).Component(ResourcesType).(*Resources).Set("gold", gold)
+		if attempts == 1 && !global.Atomic(func(s *State) bool {
+			s.Get(a).Component(ResourcesType).(*Resources).Set("gold", 10)
+			return true
+		}) {
+			t.Error("concurrent Atomic failed")
+		}
+		return true
+	}) {
+		t.Fatal("Atomic failed")
+	}
+
+	testResources(t, global, a, "gold", 10)
+	if attempts > 1 {
+		testResources(t, global, b, "gold", 10)
+	}
+	return
+}
+
+func TestAtomicSnapshotWriteSkew(t *testing.T) {
+	if attempts := testWriteSkew(t, func(s *State, f func(*State) bool) bool {
+		return s.AtomicIsolation(Snapshot, f)
+	}); attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
+
+func TestAtomicSerializableWriteSkew(t *testing.T) {
+	if attempts := testWriteSkew(t, func(s *State, f func(*State) bool) bool {
+		return s.AtomicIsolation(Serializable, f)
+	}); attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestAtomicNestedSerializableWriteSkew(t *testing.T) {
+	if attempts := testWriteSkew(t, func(s *State, f func(*State) bool) bool {
+		return s.Atomic(func(s *State) bool {
+			return s.AtomicIsolation(Serializable, f)
+		})
+	}); attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestAtomicSerializableReadCreated(t *testing.T) {
+	global := NewState()
+
+	attempts := 0
+	if !global.AtomicIsolation(Serializable, func(s *State) bool {
+		attempts++
+		id, _ := s.Create(ResourcesFactory)
+		return s.Atomic(func(s *State) bool {
+			s.Get(id).Component(ResourcesType).(*Resources).Set("gold", 1)
+			return true
+		})
+	}) {
+		t.Fatal("Atomic failed")
+	}
+	if attempts != 1 {
+		t.Errorf("expected 1 attempt, got %d", attempts)
+	}
+}
@@ -0,0 +1,108 @@
+package system
+
+import (
+	"github.com/Rnoadm/rpg"
+	"github.com/Rnoadm/rpg/history"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Loop runs a Scheduler at a fixed rate. Ticks are numbered from 1.
+type Loop struct {
+	// OnTick, if non-nil, is called after each tick with the State and the number of the
+	// tick that finished. If it returns an error, Run and Step return it.
+	OnTick func(s *rpg.State, tick uint64) error
+
+	s     *rpg.State
+	sch   *Scheduler
+	step  time.Duration
+	mtx   sync.Mutex
+	tick  uint64
+	pause bool
+}
+
+// NewLoop returns a Loop that runs sch on s once every step.
+func NewLoop(s *rpg.State, sch *Scheduler, step time.Duration) *Loop {
+	return &Loop{s: s, sch: sch, step: step}
+}
+
+// Run runs a tick every step until stop is closed or a tick returns an error. Ticks are
+// skipped while the Loop is paused. If a tick takes longer than step, the ticks that
+// were missed are skipped rather than run late, so the simulation slows down instead of
+// falling further behind.
+func (l *Loop) Run(stop <-chan struct{}) error {
+	t := time.NewTicker(l.step)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-t.C:
+		}
+		if l.Paused() {
+			continue
+		}
+		if err := l.Step(); err != nil {
+			return err
+		}
+	}
+}
+
+// Step runs a single tick immediately, even if the Loop is paused.
+func (l *Loop) Step() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	tick := l.tick + 1
+	if err := l.sch.Tick(l.s, tick); err != nil {
+		return err
+	}
+	l.tick = tick
+	if l.OnTick != nil {
+		return l.OnTick(l.s, tick)
+	}
+	return nil
+}
+
+// Pause stops Run from running ticks until Resume is called. A tick that is already
+// running finishes.
+func (l *Loop) Pause() {
+	l.mtx.Lock()
+	l.pause = true
+	l.mtx.Unlock()
+}
+
+// Resume undoes Pause.
+func (l *Loop) Resume() {
+	l.mtx.Lock()
+	l.pause = false
+	l.mtx.Unlock()
+}
+
+// Paused returns true if Pause has been called without a following call to Resume.
+func (l *Loop) Paused() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.pause
+}
+
+// Tick returns the number of the last tick that finished, or 0 if none have.
+func (l *Loop) Tick() uint64 {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return l.tick
+}
+
+// AppendTo returns a function suitable for Loop.OnTick that appends the State to h after
+// each tick, labelled "tick" with the tick number as its argument.
+func AppendTo(h *history.History) func(s *rpg.State, tick uint64) error {
+	return func(s *rpg.State, tick uint64) error {
+		return h.AppendWithMetadata(s, &history.Metadata{
+			Time:  time.Now(),
+			Label: "tick",
+			Args:  []string{strconv.FormatUint(tick, 10)},
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package system
+
+import (
+	"github.com/Rnoadm/rpg"
+	"github.com/Rnoadm/rpg/history"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoop(t *testing.T) {
+	var runs uint64
+	sch := NewScheduler()
+	sch.Add(&System{
+		Name: "count",
+		Run: func(s *rpg.State, tick uint64) bool {
+			runs++
+			if runs != tick {
+				t.Errorf("expected tick %d, got %d", runs, tick)
+			}
+			return true
+		},
+	})
+
+	l := NewLoop(rpg.NewState(), sch, time.Millisecond)
+	l.Pause()
+	if !l.Paused() {
+		t.Error("expected Loop to be paused")
+	}
+	for i := 0; i < 3; i++ {
+		if err := l.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if tick := l.Tick(); tick != 3 {
+		t.Errorf("expected tick 3, got %d", tick)
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() { done <- l.Run(stop) }()
+	time.Sleep(10 * time.Millisecond)
+	if tick := l.Tick(); tick != 3 {
+		t.Errorf("expected no ticks while paused, got tick %d", tick)
+	}
+	l.Resume()
+	for l.Tick() < 6 {
+		time.Sleep(time.Millisecond)
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAppendTo(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "testhistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	h := history.NewHistory(f)
+
+	sch := NewScheduler()
+	sch.Add(&System{
+		Name:   "create",
+		Writes: []reflect.Type{rpg.NameType},
+		Run: func(s *rpg.State, tick uint64) bool {
+			s.Create(rpg.NameFactory("tick"))
+			return true
+		},
+	})
+	l := NewLoop(rpg.NewState(), sch, time.Second)
+	l.OnTick = AppendTo(h)
+	for i := 0; i < 2; i++ {
+		if err := l.Step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n, err := h.Len(); err != nil || n != 2 {
+		t.Fatalf("expected 2 frames, got %d (%v)", n, err)
+	}
+	m, err := h.Metadata(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Label != "tick" || len(m.Args) != 1 || m.Args[0] != "2" {
+		t.Errorf("expected tick 2, got %v", m)
+	}
+	s, err := h.Seek(1, history.SeekStart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.ByComponent(rpg.NameType)); n != 2 {
+		t.Errorf("expected 2 Objects, got %d", n)
+	}
+}
@@ -0,0 +1,229 @@
+// Package system runs game logic on an rpg.State once per tick.
+//
+// A System declares the Component types it reads and writes. The Scheduler runs every
+// System once per tick inside a single call to State.Atomic, so other goroutines see
+// either none or all of a tick's changes. Systems that do not conflict run in parallel,
+// each inside its own nested call to Atomic. If two of them modify the same Object, the
+// one that commits second is run again, as with any other calls to Atomic.
+package system
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Rnoadm/rpg"
+	"reflect"
+	"sync"
+)
+
+// System is a piece of game logic that is run once per tick.
+type System struct {
+	// Name identifies the System in After and in errors. It must be unique within a
+	// Scheduler.
+	Name string
+
+	// Reads and Writes are the Component types the System uses. Two Systems conflict if
+	// one writes a type the other reads or writes. Systems that conflict are never run at
+	// the same time, and they are run in the order they were added to the Scheduler unless
+	// After says otherwise.
+	Reads, Writes []reflect.Type
+
+	// After is the names of the Systems that must finish before this System starts.
+	After []string
+
+	// Run is called once per tick with a State that contains the changes made by the
+	// Systems that ran before it. If Run returns false, its changes are discarded. Run may
+	// be called again in the same tick if it conflicts with a System running in parallel.
+	Run func(s *rpg.State, tick uint64) bool
+}
+
+func (sys *System) conflicts(other *System) bool {
+	return overlaps(sys.Writes, other.Writes) || overlaps(sys.Writes, other.Reads) || overlaps(sys.Reads, other.Writes)
+}
+
+func overlaps(a, b []reflect.Type) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var ErrDependencyCycle = errors.New("system: Systems depend on each other in a cycle")
+
+// DuplicateSystemError is returned by Scheduler.Add when a System with the same name was
+// already added.
+type DuplicateSystemError struct {
+	Name string
+}
+
+func (err *DuplicateSystemError) Error() string {
+	return fmt.Sprintf("system: duplicate System %q", err.Name)
+}
+
+// MissingDependencyError is returned by Scheduler.Tick when a System is to run after a
+// System that was not added.
+type MissingDependencyError struct {
+	Name, After string
+}
+
+func (err *MissingDependencyError) Error() string {
+	return fmt.Sprintf("system: %q runs after %q, which does not exist", err.Name, err.After)
+}
+
+// Scheduler runs Systems. It is safe to use from multiple goroutines.
+type Scheduler struct {
+	mtx     sync.Mutex
+	systems []*System
+	names   map[string]*System
+
+	// stages is the plan for running systems, computed by plan when it is nil. The
+	// Systems in each stage run in parallel after the stage before it finishes.
+	stages [][]*System
+}
+
+// NewScheduler returns a Scheduler with no Systems.
+func NewScheduler() *Scheduler {
+	return &Scheduler{names: make(map[string]*System)}
+}
+
+// Add adds sys to the Systems run by each tick. sys must not be modified afterwards.
+func (sch *Scheduler) Add(sys *System) error {
+	sch.mtx.Lock()
+	defer sch.mtx.Unlock()
+
+	if _, ok := sch.names[sys.Name]; ok {
+		return &DuplicateSystemError{Name: sys.Name}
+	}
+	sch.systems = append(sch.systems, sys)
+	sch.names[sys.Name] = sys
+	sch.stages = nil
+	return nil
+}
+
+// Stages returns the names of the Systems in the order they run. The Systems in each
+// stage run in parallel.
+func (sch *Scheduler) Stages() ([][]string, error) {
+	sch.mtx.Lock()
+	defer sch.mtx.Unlock()
+
+	if err := sch.plan(); err != nil {
+		return nil, err
+	}
+	names := make([][]string, len(sch.stages))
+	for i, stage := range sch.stages {
+		for _, sys := range stage {
+			names[i] = append(names[i], sys.Name)
+		}
+	}
+	return names, nil
+}
+
+// plan computes sch.stages if it is nil. The caller must hold sch.mtx.
+func (sch *Scheduler) plan() error {
+	if sch.stages != nil || len(sch.systems) == 0 {
+		return nil
+	}
+
+	// Sort the Systems so that each one follows the Systems it runs after, keeping the
+	// order they were added in where possible.
+	waiting := make(map[*System]int, len(sch.systems))
+	next := make(map[*System][]*System)
+	for _, sys := range sch.systems {
+		for _, name := range sys.After {
+			dep, ok := sch.names[name]
+			if !ok {
+				return &MissingDependencyError{Name: sys.Name, After: name}
+			}
+			waiting[sys]++
+			next[dep] = append(next[dep], sys)
+		}
+	}
+	var order []*System
+	done := make(map[*System]bool, len(sch.systems))
+	for len(order) < len(sch.systems) {
+		progress := false
+		for _, sys := range sch.systems {
+			if done[sys] || waiting[sys] != 0 {
+				continue
+			}
+			done[sys] = true
+			order = append(order, sys)
+			for _, n := range next[sys] {
+				waiting[n]--
+			}
+			progress = true
+			break
+		}
+		if !progress {
+			return ErrDependencyCycle
+		}
+	}
+
+	// Each System runs in the stage after the last stage containing a System it runs after
+	// or conflicts with that comes before it in order.
+	stage := make(map[*System]int, len(order))
+	var stages [][]*System
+	for i, sys := range order {
+		s := 0
+		for _, name := range sys.After {
+			if st := stage[sch.names[name]] + 1; st > s {
+				s = st
+			}
+		}
+		for _, other := range order[:i] {
+			if st := stage[other] + 1; st > s && sys.conflicts(other) {
+				s = st
+			}
+		}
+		stage[sys] = s
+		for len(stages) <= s {
+			stages = append(stages, nil)
+		}
+		stages[s] = append(stages[s], sys)
+	}
+	sch.stages = stages
+	return nil
+}
+
+// Tick runs every System once inside a call to Atomic on s. The changes made by the
+// Systems are committed together when Tick returns. If the commit conflicts with another
+// call to Atomic, every System is run again.
+func (sch *Scheduler) Tick(s *rpg.State, tick uint64) error {
+	sch.mtx.Lock()
+	err := sch.plan()
+	stages := sch.stages
+	sch.mtx.Unlock()
+	if err != nil {
+		return err
+	}
+
+	s.Atomic(func(s *rpg.State) bool {
+		for _, stage := range stages {
+			if len(stage) == 1 {
+				run(s, stage[0], tick)
+				continue
+			}
+
+			var wg sync.WaitGroup
+			for _, sys := range stage {
+				wg.Add(1)
+				go func(sys *System) {
+					defer wg.Done()
+					run(s, sys, tick)
+				}(sys)
+			}
+			wg.Wait()
+		}
+		return true
+	})
+	return nil
+}
+
+func run(s *rpg.State, sys *System, tick uint64) {
+	s.Atomic(func(s *rpg.State) bool {
+		return sys.Run(s, tick)
+	})
+}
@@ -0,0 +1,158 @@
+package system
+
+import (
+	"github.com/Rnoadm/rpg"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func testSystem(name string, reads, writes []reflect.Type, after ...string) *System {
+	return &System{
+		Name:   name,
+		Reads:  reads,
+		Writes: writes,
+		After:  after,
+		Run:    func(s *rpg.State, tick uint64) bool { return true },
+	}
+}
+
+func TestStages(t *testing.T) {
+	res := []reflect.Type{rpg.ResourcesType}
+	loc := []reflect.Type{rpg.LocationType}
+
+	sch := NewScheduler()
+	for _, sys := range []*System{
+		testSystem("move", nil, loc),
+		testSystem("mine", loc, res),
+		testSystem("regen", nil, res),
+		testSystem("log", nil, nil, "regen"),
+		testSystem("name", nil, []reflect.Type{rpg.NameType}),
+	} {
+		if err := sch.Add(sys); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stages, err := sch.Stages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"move", "name"}, {"mine"}, {"regen"}, {"log"}}
+	if !reflect.DeepEqual(stages, expected) {
+		t.Errorf("expected %v, got %v", expected, stages)
+	}
+}
+
+func TestSchedulerErrors(t *testing.T) {
+	sch := NewScheduler()
+	if err := sch.Add(testSystem("a", nil, nil, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if err, ok := sch.Add(testSystem("a", nil, nil)).(*DuplicateSystemError); !ok || err.Name != "a" {
+		t.Errorf("expected DuplicateSystemError for a, got %v", err)
+	}
+
+	if err, ok := sch.Tick(rpg.NewState(), 1).(*MissingDependencyError); !ok || err.Name != "a" || err.After != "b" {
+		t.Errorf("expected MissingDependencyError for a after b, got %v", err)
+	}
+
+	if err := sch.Add(testSystem("b", nil, nil, "a")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sch.Stages(); err != ErrDependencyCycle {
+		t.Errorf("expected ErrDependencyCycle, got %v", err)
+	}
+}
+
+func TestTick(t *testing.T) {
+	s := rpg.NewState()
+	var id rpg.ObjectIndex
+	s.Atomic(func(s *rpg.State) bool {
+		id, _ = s.Create(rpg.ResourcesFactory, rpg.LocationFactory)
+		return true
+	})
+
+	var mtx sync.Mutex
+	var order []string
+	runs := make(map[string]int)
+	record := func(name string) {
+		mtx.Lock()
+		order = append(order, name)
+		runs[name]++
+		mtx.Unlock()
+	}
+
+	// gold and move run in parallel and modify the same Object. On the first attempt of
+	// each tick, both read it before either writes, so one of them must be run again.
+	ready := make([]sync.WaitGroup, 4)
+	for i := range ready {
+		ready[i].Add(2)
+	}
+	first := make(map[string]uint64)
+	wait := func(name string, tick uint64) {
+		mtx.Lock()
+		isFirst := first[name] != tick
+		first[name] = tick
+		mtx.Unlock()
+		if isFirst {
+			ready[tick].Done()
+			ready[tick].Wait()
+		}
+	}
+
+	sch := NewScheduler()
+	sch.Add(&System{
+		Name:   "gold",
+		Writes: []reflect.Type{rpg.ResourcesType},
+		Run: func(s *rpg.State, tick uint64) bool {
+			r := s.Get(id).Component(rpg.ResourcesType).(*rpg.Resources)
+			wait("gold", tick)
+			r.Set("gold", r.Get("gold")+int64(tick))
+			record("gold")
+			return true
+		},
+	})
+	sch.Add(&System{
+		Name:   "move",
+		Writes: []reflect.Type{rpg.LocationType},
+		Run: func(s *rpg.State, tick uint64) bool {
+			l := s.Get(id).Component(rpg.LocationType).(*rpg.Location)
+			wait("move", tick)
+			x, y, z := l.Get()
+			l.Set(x+1, y, z)
+			record("move")
+			return true
+		},
+	})
+	sch.Add(&System{
+		Name:  "check",
+		Reads: []reflect.Type{rpg.ResourcesType},
+		After: []string{"move"},
+		Run: func(s *rpg.State, tick uint64) bool {
+			record("check")
+			return false
+		},
+	})
+
+	for tick := uint64(1); tick <= 3; tick++ {
+		if err := sch.Tick(s, tick); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if gold := s.Get(id).Component(rpg.ResourcesType).(*rpg.Resources).Get("gold"); gold != 6 {
+		t.Errorf("expected 6 gold, got %d", gold)
+	}
+	if x, _, _ := s.Get(id).Component(rpg.LocationType).(*rpg.Location).Get(); x != 3 {
+		t.Errorf("expected x to be 3, got %d", x)
+	}
+	if n := runs["gold"] + runs["move"]; n != 9 {
+		t.Errorf("expected 9 runs of gold and move, got %d", n)
+	}
+	for i := 0; i < len(order); i += 4 {
+		if order[i+3] != "check" {
+			t.Errorf("expected check to run last, got %v", order[i:i+4])
+		}
+	}
+}
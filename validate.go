@@ -0,0 +1,87 @@
+package rpg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidationProblem is an inconsistency found by State.Validate.
+type ValidationProblem struct {
+	ID      ObjectIndex
+	Problem string
+}
+
+func (p ValidationProblem) String() string {
+	return fmt.Sprintf("object %d: %s", p.ID, p.Problem)
+}
+
+// ValidationError is returned by State.Validate. Problems is sorted by ID.
+type ValidationError struct {
+	Problems []ValidationProblem
+}
+
+func (err *ValidationError) Error() string {
+	problems := make([]string, len(err.Problems))
+	for i, p := range err.Problems {
+		problems[i] = p.String()
+	}
+	return "rpg: invalid State: " + strings.Join(problems, "; ")
+}
+
+// Validate checks that every parent of an Object and every Object referred to by a
+// Referrer, such as a Container, exists, and that no Object is its own ancestor. It
+// returns a *ValidationError listing every problem found, or nil.
+func (s *State) Validate() error {
+	var problems []ValidationProblem
+
+	for _, id := range s.IDs() {
+		o := s.Get(id)
+
+		seen := map[ObjectIndex]bool{id: true}
+		for p := o.parent; p != 0; {
+			if seen[p] {
+				problems = append(problems, ValidationProblem{id, fmt.Sprintf("ancestor %d is its own ancestor", p)})
+				break
+			}
+			seen[p] = true
+			po := s.Get(p)
+			if po == nil {
+				if p == o.parent {
+					problems = append(problems, ValidationProblem{id, fmt.Sprintf("parent %d does not exist", p)})
+				}
+				break
+			}
+			p = po.parent
+		}
+
+		for _, c := range sortedComponents(o) {
+			if r, ok := c.(Referrer); ok {
+				for _, ref := range r.References() {
+					if s.Get(ref) == nil {
+						problems = append(problems, ValidationProblem{id, fmt.Sprintf("%T refers to missing object %d", c, ref)})
+					}
+				}
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: problems}
+}
+
+// sortedComponents returns the Components of o sorted by type name.
+func sortedComponents(o *Object) []Component {
+	types := make(sortedTypes, 0, len(o.components))
+	for t := range o.components {
+		types = append(types, t)
+	}
+	sort.Sort(types)
+	components := make([]Component, len(types))
+	for i, t := range types {
+		components[i] = o.components[t]
+	}
+	return components
+}
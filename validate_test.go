@@ -0,0 +1,62 @@
+package rpg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	global := NewState()
+	a := testCreate(t, global, ContainerFactory)
+	b := testCreate(t, global, ResourcesFactory)
+	global.Atomic(func(s *State) bool {
+		return s.Get(a).Component(ContainerType).(*Container).Add(s.Get(b))
+	})
+	if err := global.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bypass Delete to leave dangling references behind.
+	c, _ := global.Get(a).Create()
+	d, _ := global.Get(c).Create()
+	global.mtx.Lock()
+	global.objects[a].parent = d
+	delete(global.objects, b)
+	global.mtx.Unlock()
+
+	var buf bytes.Buffer
+	if err := global.EncodeTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	err := NewState().DecodeValidated(&buf)
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []ObjectIndex{a, a, c, d}
+	if len(verr.Problems) != len(expected) {
+		t.Fatalf("expected %d problems, got %v", len(expected), verr)
+	}
+	for i, id := range expected {
+		if verr.Problems[i].ID != id {
+			t.Errorf("problem %d: expected object %d, got %v", i, id, verr.Problems[i])
+		}
+	}
+}
+
+func TestDecodeChecksum(t *testing.T) {
+	global := NewState()
+	testCreate(t, global, ResourcesFactory, LocationFactory)
+	encoded, err := global.GobEncode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range encoded {
+		corrupt := append([]byte(nil), encoded...)
+		corrupt[i] ^= 0x40
+		if err := NewState().GobDecode(corrupt); err == nil {
+			t.Errorf("decoding with byte %d corrupted succeeded", i)
+		}
+	}
+}